@@ -0,0 +1,412 @@
+package localdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ErrBackupInvalid is returned (wrapped) by Open when
+// OpenOptions.VerifyBackup is set and the backup taken before
+// an upgrade fails verification. The backup file is left in
+// place for inspection.
+//
+// It is also returned (wrapped) by Restore when the backup is
+// damaged or does not belong to the schema.
+var ErrBackupInvalid = errors.New("backup failed verification")
+
+// ErrBackupExists is returned (wrapped) by Open and Plan when the
+// backup file for an upgrade already exists, and the BackupPolicy
+// neither timestamps backup names nor rotates existing files.
+var ErrBackupExists = errors.New("backup file already exists")
+
+// backupTimeFormat is appended to backup names by
+// BackupPolicy.Timestamp. It sorts lexically.
+const backupTimeFormat = "20060102T150405Z"
+
+// BackupPolicy controls the naming and retention of the backup
+// files that Open writes to OpenOptions.BackupDir.
+//
+// Retention only considers files in BackupDir that were created
+// by localdb for the same File. The newest backup is never removed.
+type BackupPolicy struct {
+	// Timestamp appends the UTC time to each backup name, such as
+	// "test.before_v2_upgrade.20261016T120000Z.db", so that repeated
+	// upgrades to the same version do not collide.
+	Timestamp bool
+
+	// RotateExisting applies when Timestamp is false. If the
+	// backup file already exists, it is renamed to include its
+	// modification time (as if Timestamp were set) rather than
+	// failing with ErrBackupExists.
+	RotateExisting bool
+
+	// KeepLast, if positive, limits the number of backups kept.
+	KeepLast int
+
+	// MaxAge, if positive, removes backups older than MaxAge.
+	MaxAge time.Duration
+
+	// MaxTotalBytes, if positive, removes the oldest backups until
+	// the total size of those remaining is at most MaxTotalBytes.
+	MaxTotalBytes int64
+}
+
+func backupFilename(options OpenOptions, schema Schema) string {
+	return backupName(options, schema.LatestVersion(), "upgrade")
+}
+
+// partialBackupFilename is the backup taken before an upgrade that
+// may commit some of its versions without the rest, such as
+// "test.before_v4_upgrade_from_v2.db". Naming the starting version
+// lets an Open that resumes a partial upgrade take its own backup.
+func partialBackupFilename(options OpenOptions, schema Schema, currentVersion int32) string {
+	return labeledBackupName(options, fmt.Sprintf("v%d_upgrade_from_v%d", schema.LatestVersion(), currentVersion))
+}
+
+// splitBackupBase returns the parts of File that backup names are
+// built from. ext includes the suffixes added by BackupTransforms.
+func splitBackupBase(options OpenOptions) (base, ext string) {
+	path, _, _ := strings.Cut(options.File, "?")
+	base = filepath.Base(path)
+	ext = filepath.Ext(base)
+	return strings.TrimSuffix(base, ext), ext + backupExt(options.BackupTransforms)
+}
+
+func backupName(options OpenOptions, version int32, direction string) string {
+	return labeledBackupName(options, fmt.Sprintf("v%d_%s", version, direction))
+}
+
+// moduleBackupName is the backup taken before upgrading modules
+// when Schema itself does not change, named for the first module
+// to be upgraded, such as "test.before_users_v2_upgrade.db".
+func moduleBackupName(options OpenOptions, m ModulePlan) string {
+	return labeledBackupName(options, fmt.Sprintf("%s_v%d_upgrade", m.Name, m.TargetVersion))
+}
+
+func labeledBackupName(options OpenOptions, label string) string {
+	base, ext := splitBackupBase(options)
+	name := fmt.Sprintf("%s.before_%s", base, label)
+
+	if options.BackupPolicy != nil && options.BackupPolicy.Timestamp {
+		return uniqueBackupName(options.BackupDir, name, ext, time.Now())
+	}
+	return filepath.Join(options.BackupDir, name+ext)
+}
+
+// uniqueBackupName returns dir/name.TIMESTAMP.ext, adding a
+// numeric suffix if another backup was taken within the same second.
+func uniqueBackupName(dir, name, ext string, t time.Time) string {
+	stamped := fmt.Sprintf("%s.%s", name, t.UTC().Format(backupTimeFormat))
+	candidate := filepath.Join(dir, stamped+ext)
+	for i := 2; fileExists(candidate); i++ {
+		candidate = filepath.Join(dir, fmt.Sprintf("%s-%d%s", stamped, i, ext))
+	}
+	return candidate
+}
+
+func fileExists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// checkBackupTarget returns an error if Open would be unable
+// to write to the backup file.
+func checkBackupTarget(options OpenOptions, path string) error {
+	if !fileExists(path) {
+		return nil
+	}
+	if options.BackupPolicy != nil && options.BackupPolicy.RotateExisting {
+		return nil
+	}
+	return fmt.Errorf("unable to create backup %s: %w", path, ErrBackupExists)
+}
+
+// createBackup writes a copy of the database to p.Backup, verifies
+// it if requested, then applies the BackupPolicy's retention rules.
+func createBackup(ctx context.Context, h sqlx.Ext, options OpenOptions, vs VersionStorer, p *UpgradePlan) error {
+	path := p.Backup
+
+	if err := os.MkdirAll(options.BackupDir, 0755); err != nil {
+		return fmt.Errorf("unable to create backup directory: %w", err)
+	}
+
+	if err := checkBackupTarget(options, path); err != nil {
+		return err
+	}
+	if fileExists(path) {
+		if err := rotateBackup(options, path); err != nil {
+			return err
+		}
+	}
+
+	// With transforms, the backup is staged unencoded so that it
+	// can be verified before it is encoded into place.
+	staged := path
+	if len(options.BackupTransforms) != 0 {
+		tmp, err := os.CreateTemp(options.BackupDir, filepath.Base(path)+".tmp-*")
+		if err != nil {
+			return fmt.Errorf("unable to create backup %s: %w", path, err)
+		}
+		tmp.Close()
+		defer os.Remove(tmp.Name())
+		staged = tmp.Name()
+	}
+
+	if _, err := h.Exec(`VACUUM INTO ?`, staged); err != nil {
+		return fmt.Errorf("unable to create backup %s: %w", path, err)
+	}
+
+	if options.VerifyBackup {
+		if err := verifyBackup(ctx, options, vs, p, staged); err != nil {
+			return err
+		}
+	}
+
+	if staged != path {
+		if err := writeBackupFile(path, staged, options.BackupTransforms); err != nil {
+			return fmt.Errorf("unable to create backup %s: %w", path, err)
+		}
+	}
+
+	if options.BackupPolicy != nil {
+		if err := pruneBackups(options, path); err != nil {
+			return fmt.Errorf("unable to prune backups: %w", err)
+		}
+	}
+	return nil
+}
+
+// verifyBackup opens the unencoded backup at path read-only and
+// checks that it is intact and has the same version information
+// as the source. Legacy databases are compared against the values
+// stored in the file, not the ones being adopted.
+func verifyBackup(ctx context.Context, options OpenOptions, vs VersionStorer, p *UpgradePlan, path string) error {
+	appId, userVersion, err := inspectBackup(ctx, options, vs, p.Backup, path, true)
+	if err != nil {
+		return err
+	}
+	if appId != p.storedAppID {
+		return invalidBackup(p.Backup, "application_id (%d) does not match source (%d)", appId, p.storedAppID)
+	}
+	if userVersion != p.storedVersion {
+		return invalidBackup(p.Backup, "user_version (%d) does not match source (%d)", userVersion, p.storedVersion)
+	}
+	return nil
+}
+
+func invalidBackup(name, format string, args ...any) error {
+	return fmt.Errorf("%w: %s: %s", ErrBackupInvalid, name, fmt.Sprintf(format, args...))
+}
+
+// inspectBackup opens the unencoded backup at path read-only,
+// checks that it is intact, and returns its version information.
+// If foreignKeys is true, it must also pass foreign_key_check.
+// Errors wrap ErrBackupInvalid and refer to the backup as name.
+func inspectBackup(ctx context.Context, options OpenOptions, vs VersionStorer, name, path string, foreignKeys bool) (appId, userVersion int32, err error) {
+	dsn, err := assembleDSN(path, url.Values{"mode": {"ro"}})
+	if err != nil {
+		return 0, 0, invalidBackup(name, "%v", err)
+	}
+	sq, err := sqlx.Open(options.DriverName, fmt.Sprintf("file:%s", dsn))
+	if err != nil {
+		return 0, 0, invalidBackup(name, "%v", err)
+	}
+	defer sq.Close()
+	sq.SetMaxOpenConns(1)
+	q := bindContext(ctx, sq.DriverName(), sq)
+
+	var problems []string
+	if err = sqlx.Select(q, &problems, `SELECT * FROM pragma_integrity_check`); err != nil {
+		return 0, 0, invalidBackup(name, "integrity_check: %v", err)
+	}
+	if len(problems) != 1 || problems[0] != "ok" {
+		return 0, 0, invalidBackup(name, "integrity_check: %s", strings.Join(problems, "; "))
+	}
+
+	if foreignKeys {
+		var violations int
+		if err = sqlx.Get(q, &violations, `SELECT COUNT(*) FROM pragma_foreign_key_check`); err != nil {
+			return 0, 0, invalidBackup(name, "foreign_key_check: %v", err)
+		}
+		if violations != 0 {
+			return 0, 0, invalidBackup(name, "foreign_key_check: %d violations", violations)
+		}
+	}
+
+	if appId, err = vs.GetApplicationId(q); err != nil {
+		return 0, 0, invalidBackup(name, "%v", err)
+	}
+	if userVersion, err = vs.GetUserVersion(q); err != nil {
+		return 0, 0, invalidBackup(name, "%v", err)
+	}
+	return appId, userVersion, nil
+}
+
+// encodeBackupFile copies src to w, applying transforms.
+func encodeBackupFile(w io.Writer, src string, transforms []BackupTransform) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	enc, err := encodeBackup(w, transforms)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(enc, in); err != nil {
+		enc.Close()
+		return err
+	}
+	return enc.Close()
+}
+
+// writeBackupFile writes src to a new file at dst, applying
+// transforms.
+func writeBackupFile(dst, src string, transforms []BackupTransform) (err error) {
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(dst)
+		}
+	}()
+
+	if err = encodeBackupFile(out, src, transforms); err != nil {
+		return err
+	}
+	return out.Sync()
+}
+
+// rotateBackup renames an existing backup to include its
+// modification time.
+func rotateBackup(options OpenOptions, path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	_, ext := splitBackupBase(options)
+	name := strings.TrimSuffix(filepath.Base(path), ext)
+	rotated := uniqueBackupName(filepath.Dir(path), name, ext, info.ModTime())
+	if err = os.Rename(path, rotated); err != nil {
+		return fmt.Errorf("unable to rotate existing backup %s: %w", path, err)
+	}
+	return nil
+}
+
+type backupInfo struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// backupPattern matches the names of backups of File.
+func backupPattern(options OpenOptions) *regexp.Regexp {
+	base, ext := splitBackupBase(options)
+	return regexp.MustCompile(`^` + regexp.QuoteMeta(base) +
+		`\.before_(` + moduleNamePattern + `_)?v\d+_(upgrade(_from_v\d+)?|downgrade)(\.\d{8}T\d{6}Z(-\d+)?)?` +
+		regexp.QuoteMeta(ext) + `$`)
+}
+
+// listBackups returns the backups of File in BackupDir,
+// newest first.
+func listBackups(options OpenOptions) ([]backupInfo, error) {
+	return listBackupFiles(options.BackupDir, backupPattern(options))
+}
+
+// listBackupFiles returns the files in dir matching pattern,
+// newest first.
+func listBackupFiles(dir string, pattern *regexp.Regexp) ([]backupInfo, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []backupInfo
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !pattern.MatchString(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		backups = append(backups, backupInfo{
+			path:    filepath.Join(dir, entry.Name()),
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		})
+	}
+
+	slices.SortFunc(backups, func(a, b backupInfo) int {
+		if c := b.modTime.Compare(a.modTime); c != 0 {
+			return c
+		}
+		return strings.Compare(b.path, a.path)
+	})
+	return backups, nil
+}
+
+// pruneBackups applies the BackupPolicy's retention rules,
+// never removing newest.
+func pruneBackups(options OpenOptions, newest string) error {
+	backups, err := listBackups(options)
+	if err != nil {
+		return err
+	}
+	return pruneBackupFiles(options.BackupPolicy, backups, newest)
+}
+
+// pruneBackupFiles applies policy's retention rules to backups,
+// never removing newest.
+func pruneBackupFiles(policy *BackupPolicy, backups []backupInfo, newest string) error {
+	// Ensure the backup that was just taken counts as the newest,
+	// even if the filesystem's timestamps are coarse.
+	slices.SortStableFunc(backups, func(a, b backupInfo) int {
+		switch {
+		case a.path == newest:
+			return -1
+		case b.path == newest:
+			return 1
+		}
+		return 0
+	})
+
+	var errs []error
+	var kept int
+	var total int64
+	var full bool
+	for i, backup := range backups {
+		// Once a backup exceeds MaxTotalBytes, it and every older
+		// backup are removed, even ones small enough to fit.
+		full = full || (policy.MaxTotalBytes > 0 && total+backup.size > policy.MaxTotalBytes)
+		if i > 0 && (full ||
+			(policy.KeepLast > 0 && kept >= policy.KeepLast) ||
+			(policy.MaxAge > 0 && time.Since(backup.modTime) > policy.MaxAge)) {
+			if err := os.Remove(backup.path); err != nil {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		kept++
+		total += backup.size
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,213 @@
+package localdb
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/require"
+)
+
+func openRaw(t *testing.T, file string) *sqlx.DB {
+	t.Helper()
+	sq, err := sqlx.Open("sqlite", "file:"+file)
+	require.NoError(t, err)
+	t.Cleanup(func() { sq.Close() })
+	return sq
+}
+
+func backupNames(t *testing.T, options OpenOptions) []string {
+	t.Helper()
+	backups, err := listBackups(options)
+	require.NoError(t, err)
+	names := make([]string, len(backups))
+	for i, b := range backups {
+		names[i] = filepath.Base(b.path)
+	}
+	return names
+}
+
+func (suite *DBTestSuite) TestBackupExists() {
+	dir := filepath.Dir(suite.DBFile)
+	schema := NewSqlSchema(`CREATE TABLE t ( foo TEXT )`)
+	options := OpenOptions{
+		File:       suite.DBFile,
+		Schema:     schema,
+		DriverName: "sqlite",
+		BackupDir:  filepath.Join(dir, "backups"),
+	}
+
+	db, err := Open(options)
+	suite.Require().NoError(err)
+	suite.Require().NoError(db.Close())
+
+	schema.DefineUpgrade(2, `ALTER TABLE t ADD COLUMN bar TEXT;`)
+	target := filepath.Join(options.BackupDir, "test.before_v2_upgrade.db")
+	suite.Require().NoError(os.MkdirAll(options.BackupDir, 0755))
+	suite.Require().NoError(os.WriteFile(target, []byte("stale"), 0644))
+
+	p, err := Plan(options)
+	suite.Require().NoError(err)
+	suite.Require().ErrorIs(p.Err, ErrBackupExists)
+
+	_, err = Open(options)
+	suite.Require().ErrorIs(err, ErrBackupExists)
+
+	options.BackupPolicy = &BackupPolicy{RotateExisting: true}
+	db, err = Open(options)
+	suite.Require().NoError(err)
+	suite.Require().NoError(db.Close())
+
+	names := backupNames(suite.T(), options)
+	suite.Require().Len(names, 2)
+	suite.Require().Contains(names, "test.before_v2_upgrade.db")
+	suite.Require().Regexp(`^test\.before_v2_upgrade\.\d{8}T\d{6}Z\.db$`, names[1])
+	stale, err := os.ReadFile(filepath.Join(options.BackupDir, names[1]))
+	suite.Require().NoError(err)
+	suite.Require().Equal("stale", string(stale))
+}
+
+func (suite *DBTestSuite) TestBackupRetention() {
+	dir := filepath.Dir(suite.DBFile)
+	schema := NewSqlSchema(`CREATE TABLE t ( foo TEXT )`)
+	options := OpenOptions{
+		File:         suite.DBFile,
+		Schema:       schema,
+		DriverName:   "sqlite",
+		BackupDir:    dir,
+		BackupPolicy: &BackupPolicy{Timestamp: true, KeepLast: 2},
+	}
+
+	db, err := Open(options)
+	suite.Require().NoError(err)
+	suite.Require().NoError(db.Close())
+
+	for v := 2; v <= 4; v++ {
+		schema.DefineUpgrade(v, `SELECT 1;`)
+		db, err = Open(options)
+		suite.Require().NoError(err)
+		suite.Require().NoError(db.Close())
+	}
+
+	names := backupNames(suite.T(), options)
+	suite.Require().Len(names, 2)
+	suite.Require().Regexp(`^test\.before_v4_upgrade\.\d{8}T\d{6}Z\.db$`, names[0])
+	suite.Require().Regexp(`^test\.before_v3_upgrade\.\d{8}T\d{6}Z\.db$`, names[1])
+	suite.Require().FileExists(options.File, "retention must not touch the database itself")
+
+	// Backups of other databases in the same directory are ignored
+	other := filepath.Join(dir, "other.before_v2_upgrade.db")
+	suite.Require().NoError(os.WriteFile(other, nil, 0644))
+
+	old := filepath.Join(dir, "test.before_v1_upgrade.20000101T000000Z.db")
+	suite.Require().NoError(os.WriteFile(old, make([]byte, 100), 0644))
+	longAgo := time.Now().Add(-48 * time.Hour)
+	suite.Require().NoError(os.Chtimes(old, longAgo, longAgo))
+
+	options.BackupPolicy = &BackupPolicy{MaxAge: 24 * time.Hour}
+	suite.Require().NoError(pruneBackups(options, filepath.Join(dir, names[0])))
+	suite.Require().NoFileExists(old)
+	suite.Require().FileExists(other)
+	suite.Require().Len(backupNames(suite.T(), options), 2)
+
+	options.BackupPolicy = &BackupPolicy{MaxTotalBytes: 1}
+	suite.Require().NoError(pruneBackups(options, filepath.Join(dir, names[0])))
+	suite.Require().Equal(names[:1], backupNames(suite.T(), options), "the newest backup is kept even if it exceeds MaxTotalBytes")
+
+	// Older backups that would fit are removed along with the
+	// first backup over the limit
+	var backups []backupInfo
+	now := time.Now()
+	for i, size := range []int64{10, 100, 5} {
+		path := filepath.Join(dir, fmt.Sprintf("test.before_v%d_upgrade.db", 9-i))
+		suite.Require().NoError(os.WriteFile(path, make([]byte, size), 0644))
+		backups = append(backups, backupInfo{path: path, modTime: now.Add(-time.Duration(i) * time.Hour), size: size})
+	}
+	suite.Require().NoError(pruneBackupFiles(&BackupPolicy{MaxTotalBytes: 20}, backups, backups[0].path))
+	suite.Require().FileExists(backups[0].path)
+	suite.Require().NoFileExists(backups[1].path)
+	suite.Require().NoFileExists(backups[2].path)
+}
+
+func (suite *DBTestSuite) TestVerifyBackup() {
+	dir := filepath.Dir(suite.DBFile)
+	schema := NewSqlSchema(`
+CREATE TABLE parent ( id INTEGER PRIMARY KEY );
+CREATE TABLE child ( parent_id INTEGER REFERENCES parent (id) );`)
+	options := OpenOptions{
+		File:         suite.DBFile,
+		Schema:       schema,
+		DriverName:   "sqlite",
+		BackupDir:    dir,
+		BackupPolicy: &BackupPolicy{Timestamp: true},
+		VerifyBackup: true,
+	}
+
+	db, err := Open(options)
+	suite.Require().NoError(err)
+	_, err = db.Handle().Exec(`INSERT INTO parent (id) VALUES (1); INSERT INTO child (parent_id) VALUES (1);`)
+	suite.Require().NoError(err)
+	suite.Require().NoError(db.Close())
+
+	schema.DefineUpgrade(2, `SELECT 1;`)
+	db, err = Open(options)
+	suite.Require().NoError(err)
+	// foreign_keys is off by default, so this orphans a row
+	_, err = db.Handle().Exec(`DELETE FROM parent`)
+	suite.Require().NoError(err)
+	suite.Require().NoError(db.Close())
+
+	schema.DefineUpgrade(3, `SELECT 1;`)
+	_, err = Open(options)
+	suite.Require().ErrorIs(err, ErrBackupInvalid)
+	suite.Require().ErrorContains(err, "foreign_key_check: 1 violations")
+
+	userVersion, err := (&SqliteVersion{}).GetUserVersion(openRaw(suite.T(), options.File))
+	suite.Require().NoError(err)
+	suite.Require().Equal(int32(2), userVersion, "upgrade should not run after a failed verification")
+
+	_, _, err = inspectBackup(context.Background(), options, &SqliteVersion{}, "bad", filepath.Join(dir, "bad.db?%zz"), false)
+	suite.Require().ErrorIs(err, ErrBackupInvalid, "an unparseable path is invalid too")
+}
+
+func (suite *DBTestSuite) TestVerifyLegacyBackup() {
+	sq := openRaw(suite.T(), suite.DBFile)
+	_, err := sq.Exec(`CREATE TABLE t ( foo TEXT ); INSERT INTO t (foo) VALUES ('legacy');`)
+	suite.Require().NoError(err)
+	suite.Require().NoError(sq.Close())
+
+	schema := NewSqlSchema(`CREATE TABLE t ( foo TEXT )`)
+	schema.DefineUpgrade(2, `ALTER TABLE t ADD COLUMN bar TEXT;`)
+	schema.DefineLegacy(func(q sqlx.Queryer) (int32, int32, error) {
+		exists, err := tableExists(q, "t")
+		if err != nil || !exists {
+			return 0, 0, err
+		}
+		return schema.ApplicationID(), 1, nil
+	})
+	options := OpenOptions{
+		File:         suite.DBFile,
+		Schema:       schema,
+		DriverName:   "sqlite",
+		BackupDir:    filepath.Join(filepath.Dir(suite.DBFile), "backups"),
+		VerifyBackup: true,
+	}
+
+	// The backup has no application_id yet, like the file it was taken from
+	db, err := Open(options)
+	suite.Require().NoError(err)
+	suite.Require().NoError(db.Close())
+
+	backup := openRaw(suite.T(), filepath.Join(options.BackupDir, "test.before_v2_upgrade.db"))
+	appId, err := (&SqliteVersion{}).GetApplicationId(backup)
+	suite.Require().NoError(err)
+	suite.Require().Zero(appId)
+
+	userVersion, err := (&SqliteVersion{}).GetUserVersion(openRaw(suite.T(), options.File))
+	suite.Require().NoError(err)
+	suite.Require().Equal(int32(2), userVersion)
+}
@@ -0,0 +1,80 @@
+package localdb
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// HandleContext is a Handle that additionally exposes the
+// context-aware sqlx methods.
+//
+// Handles passed to WrapTxContext callbacks, OnOpen hooks and
+// schema upgrades implement HandleContext. Their non-context
+// methods (Exec, Queryx, etc.) are bound to the context that
+// was supplied to the originating call, so existing code that
+// only uses sqlx.Ext still honors cancellation.
+type HandleContext interface {
+	Handle
+	sqlx.ExtContext
+	PrepareContext(context.Context, string) (*sql.Stmt, error)
+	PreparexContext(context.Context, string) (*sqlx.Stmt, error)
+}
+
+// contextExt is satisfied by *sqlx.DB, *sqlx.Tx and *sqlx.Conn.
+type contextExt interface {
+	sqlx.QueryerContext
+	sqlx.ExecerContext
+	PrepareContext(context.Context, string) (*sql.Stmt, error)
+	PreparexContext(context.Context, string) (*sqlx.Stmt, error)
+	Rebind(string) string
+}
+
+// boundHandle adapts a contextExt into a HandleContext whose
+// non-context methods use a fixed context.
+type boundHandle struct {
+	ctx        context.Context
+	driverName string
+	contextExt
+}
+
+func bindContext(ctx context.Context, driverName string, ext contextExt) *boundHandle {
+	return &boundHandle{
+		ctx:        ctx,
+		driverName: driverName,
+		contextExt: ext,
+	}
+}
+
+func (b *boundHandle) DriverName() string {
+	return b.driverName
+}
+
+func (b *boundHandle) BindNamed(query string, arg any) (string, []any, error) {
+	return sqlx.BindNamed(sqlx.BindType(b.driverName), query, arg)
+}
+
+func (b *boundHandle) Exec(query string, args ...any) (sql.Result, error) {
+	return b.ExecContext(b.ctx, query, args...)
+}
+
+func (b *boundHandle) Query(query string, args ...any) (*sql.Rows, error) {
+	return b.QueryContext(b.ctx, query, args...)
+}
+
+func (b *boundHandle) Queryx(query string, args ...any) (*sqlx.Rows, error) {
+	return b.QueryxContext(b.ctx, query, args...)
+}
+
+func (b *boundHandle) QueryRowx(query string, args ...any) *sqlx.Row {
+	return b.QueryRowxContext(b.ctx, query, args...)
+}
+
+func (b *boundHandle) Prepare(query string) (*sql.Stmt, error) {
+	return b.PrepareContext(b.ctx, query)
+}
+
+func (b *boundHandle) Preparex(query string) (*sqlx.Stmt, error) {
+	return b.PreparexContext(b.ctx, query)
+}
@@ -1,6 +1,7 @@
 package localdb
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
@@ -15,9 +16,16 @@ import (
 var errDetectPanic = errors.New("this should never happen")
 
 type DB struct {
-	opened time.Time
-	root   *sqlx.DB
-	schema Schema
+	opened  time.Time
+	options OpenOptions
+	file    string
+	root    *sqlx.DB
+	reader  *sqlx.DB
+	schema  Schema
+	vs      VersionStorer
+	retry   *RetryPolicy
+
+	onBackupProgress func(BackupProgress)
 }
 
 // Handle represents a database handle, which may or may not
@@ -142,7 +150,9 @@ type OpenOptions struct {
 	// Schema to use for database upgrades.
 	Schema Schema
 
-	// Optional, defaults to SqliteVersion.
+	// Optional. If nil, the Schema's default is used if it
+	// implements VersionStorerProvider (as SqlSchema does), and
+	// otherwise SqliteVersion.
 	VersionStorer VersionStorer
 
 	// If BackupDir is non-empty, a backup database
@@ -164,6 +174,89 @@ type OpenOptions struct {
 	// dot-prefix if the main database file was also dot-prefixed.
 	BackupDir string
 
+	// BackupPolicy controls the naming and retention of files in
+	// BackupDir. If nil, backups are never removed, and Open fails
+	// with ErrBackupExists if the backup file is already present.
+	BackupPolicy *BackupPolicy
+
+	// VerifyBackup, if true, checks each backup taken by Open
+	// before the upgrade proceeds. The backup is opened read-only
+	// and must pass PRAGMA integrity_check and foreign_key_check,
+	// and its application_id and user_version (as read by the
+	// VersionStorer) must match the source database. If any check
+	// fails, Open returns an error wrapping ErrBackupInvalid
+	// without upgrading. Restore also runs foreign_key_check on
+	// the backup when VerifyBackup is set.
+	VerifyBackup bool
+
+	// BackupTransforms, if non-empty, are applied in order to
+	// every backup written by Open, DB.Backup and DB.BackupTo,
+	// such as GzipTransform followed by an AESGCMTransform to
+	// compress and then encrypt. Each transform's Ext is appended
+	// to the names of backups Open takes, so with both of the
+	// above, "test.db" is backed up to
+	// "test.before_v2_upgrade.db.gz.enc".
+	//
+	// Use RestoreBackup with the same transforms to reverse them.
+	BackupTransforms []BackupTransform
+
+	// RestoreOnFailure, if true, puts the backup taken by Open
+	// back in place of File when the upgrade (or downgrade) fails
+	// after the backup was taken. This protects against upgrade
+	// hooks with side effects outside the upgrade transaction.
+	// Any -wal, -shm or -journal files belonging to File are
+	// removed, and the backup is copied over File atomically.
+	//
+	// When a restore is attempted, Open returns a *RestoreError.
+	// RestoreOnFailure has no effect unless BackupDir is set.
+	RestoreOnFailure bool
+
+	// StepwiseUpgrade, if true, commits each version of an upgrade
+	// in its own transaction, along with the new user_version,
+	// instead of applying every pending version in one transaction.
+	// If the upgrade fails or is interrupted, the versions already
+	// committed are kept, and the next Open resumes from the first
+	// version that did not commit. The Schema must implement
+	// StepUpgrader, as SqlSchema does.
+	//
+	// The backup, if any, is taken once before the first version,
+	// and is named for the version the upgrade starts from, such as
+	// "${BASENAME}.before_v4_upgrade_from_v2.${EXT}". An Open that
+	// resumes a partial upgrade takes a new backup of the partially
+	// upgraded database, under a name of its own. RestoreOnFailure
+	// restores that backup, discarding the versions committed by
+	// the failed Open. Downgrades always run in a single transaction.
+	StepwiseUpgrade bool
+
+	// AllowDowngrade permits Open to roll back a database whose
+	// version is higher than the Schema's LatestVersion, using
+	// the steps registered with SqlSchema.DefineDowngrade (or any
+	// Schema implementing Downgrader). If BackupDir is set, a
+	// backup named "${BASENAME}.before_v%d_downgrade.${EXT}" is
+	// taken first, where %d is the version being rolled back to.
+	//
+	// If AllowDowngrade is false (the default), Open returns an
+	// error for such databases.
+	AllowDowngrade bool
+
+	// Modules, if non-empty, are upgraded after Schema, each to
+	// its own latest version, in dependency order (see
+	// ModuleSchema.DependsOn). Each module's version is tracked
+	// in the localdb_modules table, independently of Schema's
+	// application_id and user_version, so a module can be
+	// upgraded while Schema is already up to date.
+	//
+	// Modules are upgraded in the same transaction as Schema, so
+	// if any module fails, neither Schema nor any module changes.
+	// With StepwiseUpgrade or DefineUpgradeNoTx, they share the
+	// last transaction (or follow the last step, if it is NoTx),
+	// and earlier versions of Schema stay committed.
+	//
+	// If BackupDir is set and Schema is unchanged, a backup named
+	// for the first module is taken before the modules are
+	// upgraded, such as "${BASENAME}.before_users_v2_upgrade.${EXT}".
+	Modules []ModuleSchema
+
 	// Connection options. Format is driver-specific; refer to your
 	// SQLite driver's documentation (e.g. github.com/mattn/go-sqlite3
 	// or modernc.org/sqlite). These are added to any baked-in options
@@ -181,6 +274,19 @@ type OpenOptions struct {
 	// set to 1 (the default.)
 	MaxOpenConns int
 
+	// ReadConns, if non-zero, opens a second connection pool to
+	// File with mode=ro for use by ReadHandle and WrapReadTx, so
+	// that readers are not serialized behind the (by default
+	// single) writer connection. This is most useful in WAL mode.
+	// If ReadConns <= -1, the read pool has no connection limit.
+	// If ReadConns == 0 (the default), no read pool is opened and
+	// reads share the writer's pool.
+	//
+	// The read pool is opened with the same DSNOptions as the
+	// writer, plus mode=ro and minus any journal_mode, which a
+	// read-only connection cannot change.
+	ReadConns int
+
 	// DriverName selects which database/sql driver to open the
 	// database with. Required. The driver must be registered under
 	// this name (typically via a blank import in the caller's main
@@ -199,7 +305,19 @@ type OpenOptions struct {
 	//
 	// If OnOpen returns an error, Open closes the database and returns
 	// the error.
+	//
+	// When opened via OpenContext, the Handle passed to OnOpen is a
+	// HandleContext bound to the supplied context.
 	OnOpen func(Handle) error
+
+	// OnBackupProgress, if non-nil, is invoked periodically
+	// during DB.Backup and DB.BackupTo.
+	OnBackupProgress func(BackupProgress)
+
+	// Retry, if non-nil, enables automatic retries of WrapTx
+	// (including the upgrade transaction run by Open) when the
+	// transaction fails with a busy or locked error.
+	Retry *RetryPolicy
 }
 
 func assembleDSN(inputDSN string, dsnOpts url.Values) (dsn string, err error) {
@@ -244,6 +362,15 @@ func assembleDSN(inputDSN string, dsnOpts url.Values) (dsn string, err error) {
 // for use by this library, and are set to the current SqlSchema's
 // schemaId and version, respectively.
 func Open(options OpenOptions) (*DB, error) {
+	return OpenContext(context.Background(), options)
+}
+
+// OpenContext is like Open, but ctx is used for all database
+// activity performed while opening, including the OnOpen hook,
+// VersionStorer calls, and the schema upgrade transaction.
+// If ctx is cancelled during the upgrade, the transaction is
+// rolled back and the database is closed.
+func OpenContext(ctx context.Context, options OpenOptions) (*DB, error) {
 	now := time.Now()
 
 	dsn, err := assembleDSN(options.File, options.DSNOptions)
@@ -272,25 +399,57 @@ func Open(options OpenOptions) (*DB, error) {
 		sq.SetMaxOpenConns(options.MaxOpenConns)
 	}
 
+	// Copied like Schema, as VerifySchema applies them later
+	options.Modules = copyModules(options.Modules)
+
+	file, _, _ := strings.Cut(options.File, "?")
 	db := &DB{
-		opened: now,
-		root:   sq,
-		schema: options.Schema.Copy(),
+		opened:  now,
+		options: options,
+		file:    file,
+		root:    sq,
+		schema:  options.Schema.Copy(),
 	}
 
-	vs := options.VersionStorer
-	if vs == nil {
-		vs = &SqliteVersion{}
+	if options.Retry != nil {
+		retry := *options.Retry
+		db.retry = &retry
 	}
+	db.onBackupProgress = options.OnBackupProgress
+
+	vs := versionStorer(options)
+	db.vs = vs
 
 	if options.OnOpen != nil {
-		if err := options.OnOpen(db.Handle()); err != nil {
+		if err := options.OnOpen(db.handleContext(ctx)); err != nil {
 			return nil, fmt.Errorf("OnOpen hook: %w", err)
 		}
 	}
 
-	if err = initDB(db, options, vs); err != nil {
-		return nil, err
+	if backup, err := initDB(ctx, db, options, vs); err != nil {
+		if backup == "" || !options.RestoreOnFailure {
+			return nil, err
+		}
+
+		// The database must be closed before its file is replaced
+		var closeErr error
+		once.Do(func() {
+			closeErr = sq.Close()
+		})
+		if closeErr != nil {
+			return nil, &RestoreError{Err: err, Backup: backup, RestoreErr: closeErr}
+		}
+		return nil, &RestoreError{Err: err, Backup: backup, RestoreErr: replaceDatabaseFile(backup, options.File, options.BackupTransforms)}
+	}
+
+	if err = migrateFallback(ctx, db, vs); err != nil {
+		return nil, fmt.Errorf("unable to migrate version from FallbackReader: %w", err)
+	}
+
+	if options.ReadConns != 0 {
+		if db.reader, err = openReader(ctx, options, options.ReadConns); err != nil {
+			return nil, fmt.Errorf("unable to open read pool: %w", err)
+		}
 	}
 
 	once.Do(func() {
@@ -299,6 +458,21 @@ func Open(options OpenOptions) (*DB, error) {
 	return db, nil
 }
 
+// versionStorer returns the VersionStorer that Open should use:
+// OpenOptions.VersionStorer if set, then the Schema's default
+// (see VersionStorerProvider), then SqliteVersion.
+func versionStorer(options OpenOptions) VersionStorer {
+	if options.VersionStorer != nil {
+		return options.VersionStorer
+	}
+	if p, ok := options.Schema.(VersionStorerProvider); ok {
+		if vs := p.DefaultVersionStorer(); vs != nil {
+			return vs
+		}
+	}
+	return &SqliteVersion{}
+}
+
 // WrapTx begins a new transaction and invokes fn().
 // If fn() panics or returns an error, the transaction is
 // discarded and the error is returned.
@@ -313,26 +487,54 @@ func Open(options OpenOptions) (*DB, error) {
 //
 //	func(sqlx.Ext) error
 //	func(Handle) error
+//	func(HandleContext) error
+//	func(*Tx) error
+//
+// The Handle passed to fn is always a *Tx, whose WrapTx method
+// nests further transactions using SAVEPOINT.
 //
 // If fn does not have one of the above signatures, WrapTx
 // will panic without attempting to begin a transaction.
+//
+// If the DB was opened with a RetryPolicy, fn may be invoked
+// more than once, each time on a fresh transaction.
 func (d *DB) WrapTx(fn any) error {
-	var f func(Handle) error
+	return d.WrapTxContext(context.Background(), fn)
+}
+
+// WrapTxContext is like WrapTx, but begins the transaction with
+// ctx. The Handle passed to fn is a HandleContext whose methods
+// are bound to ctx. If ctx is cancelled before the transaction
+// commits, the transaction is rolled back and the context's
+// error is returned.
+func (d *DB) WrapTxContext(ctx context.Context, fn any) error {
+	return d.WrapTxModeContext(ctx, TxDeferred, fn)
+}
 
+// txFunc normalizes the function signatures accepted by WrapTx.
+func txFunc(fn any) func(HandleContext) error {
 	switch fn := fn.(type) {
+	case func(*Tx) error:
+		return func(h HandleContext) error {
+			return fn(h.(*Tx))
+		}
+	case func(HandleContext) error:
+		return fn
 	case func(Handle) error:
-		f = fn
-		break
+		return func(h HandleContext) error {
+			return fn(h)
+		}
 	case func(sqlx.Ext) error:
-		f = func(h Handle) error {
+		return func(h HandleContext) error {
 			return fn(h)
 		}
-		break
 	default:
 		panic("invalid function signature passed to WrapTx")
 	}
+}
 
-	tx, err := d.root.Beginx()
+func (d *DB) wrapTx(ctx context.Context, pool *sqlx.DB, opts *sql.TxOptions, f func(HandleContext) error) error {
+	tx, err := pool.BeginTxx(ctx, opts)
 	if err != nil {
 		return err
 	}
@@ -342,12 +544,19 @@ func (d *DB) WrapTx(fn any) error {
 		// This will only be triggered if we returned prior
 		// to committing the transaction, in which case the
 		// wrapped fn returned an error or panicked.
-		if err := tx.Rollback(); err != nil {
+		// database/sql rolls back on its own when ctx is
+		// cancelled, so ErrTxDone is expected in that case.
+		if err := tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
 			panic(err)
 		}
 	})
 
-	if err = f(tx); err != nil {
+	if err = f(newTx(bindContext(ctx, pool.DriverName(), tx), 0)); err != nil {
+		return err
+	}
+
+	// Don't commit if ctx was cancelled after fn's last statement
+	if err = ctx.Err(); err != nil {
 		return err
 	}
 
@@ -358,6 +567,11 @@ func (d *DB) WrapTx(fn any) error {
 	if errors.Is(err, errDetectPanic) {
 		panic("logic error")
 	}
+	// ctx may be cancelled while committing, in which case
+	// database/sql's background rollback can win the race
+	if errors.Is(err, sql.ErrTxDone) && ctx.Err() != nil {
+		return ctx.Err()
+	}
 	return err
 }
 
@@ -365,6 +579,13 @@ func (d *DB) Handle() Handle {
 	return d.root
 }
 
+func (d *DB) handleContext(ctx context.Context) HandleContext {
+	return bindContext(ctx, d.root.DriverName(), d.root)
+}
+
 func (d *DB) Close() error {
+	if d.reader != nil {
+		return errors.Join(d.reader.Close(), d.root.Close())
+	}
 	return d.root.Close()
 }
@@ -1,12 +1,14 @@
 package localdb
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/jmoiron/sqlx"
@@ -144,6 +146,60 @@ func (suite *DBTestSuite) TestOpen() {
 	suite.Require().NoError(db.Close())
 }
 
+func (suite *DBTestSuite) TestOpenContextCancelled() {
+	schema := NewSqlSchema(`CREATE TABLE t ( foo TEXT )`)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := OpenContext(ctx, OpenOptions{File: suite.DBFile, Schema: schema, DriverName: "sqlite"})
+	suite.Require().ErrorIs(err, context.Canceled)
+
+	db, err := Open(OpenOptions{File: suite.DBFile, Schema: schema, DriverName: "sqlite"})
+	suite.Require().NoError(err)
+	userVersion, err := (&SqliteVersion{}).GetUserVersion(db.Handle())
+	suite.Require().NoError(err)
+	suite.Require().Equal(int32(1), userVersion, "cancelled OpenContext should not have left a partial upgrade")
+	suite.Require().NoError(db.Close())
+}
+
+func (suite *DBTestSuite) TestWrapTxContext() {
+	schema := NewSqlSchema(`CREATE TABLE t ( foo TEXT )`)
+
+	db, err := Open(OpenOptions{File: suite.DBFile, Schema: schema, DriverName: "sqlite"})
+	suite.Require().NoError(err)
+	defer db.Close()
+
+	suite.Require().NoError(db.WrapTxContext(context.Background(), func(tx HandleContext) error {
+		_, err := tx.ExecContext(context.Background(), `INSERT INTO t (foo) VALUES (?)`, "kept")
+		return err
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	err = db.WrapTxContext(ctx, func(tx Handle) error {
+		if _, err := tx.Exec(`INSERT INTO t (foo) VALUES (?)`, "discarded"); err != nil {
+			return err
+		}
+		cancel()
+		_, err := tx.Exec(`INSERT INTO t (foo) VALUES (?)`, "discarded")
+		return err
+	})
+	suite.Require().ErrorIs(err, context.Canceled)
+
+	// Cancelled after fn's last statement, but before commit
+	ctx, cancel = context.WithCancel(context.Background())
+	err = db.WrapTxContext(ctx, func(tx Handle) error {
+		defer cancel()
+		_, err := tx.Exec(`INSERT INTO t (foo) VALUES (?)`, "discarded")
+		return err
+	})
+	suite.Require().ErrorIs(err, context.Canceled)
+
+	var count int
+	suite.Require().NoError(sqlx.Get(db.Handle(), &count, `SELECT COUNT(*) FROM t`))
+	suite.Require().Equal(1, count)
+}
+
 func (suite *DBTestSuite) TestUpgrade() {
 	schema := NewSqlSchema(`CREATE TABLE t ( foo TEXT, bar NUMERIC )`)
 	schema.DefineUpgrade(2, `
@@ -214,6 +270,256 @@ func (suite *DBTestSuite) TestUpgradeHookFailure() {
 	suite.Require().EqualError(err, "error during v2 post-upgrade hook: hook failed")
 }
 
+func (suite *DBTestSuite) TestStepwiseUpgrade() {
+	schema := NewSqlSchema(`CREATE TABLE t ( foo TEXT )`)
+	schema.RecordHistory = true
+	options := OpenOptions{File: suite.DBFile, Schema: schema, DriverName: "sqlite", StepwiseUpgrade: true}
+
+	db, err := Open(options)
+	suite.Require().NoError(err)
+	suite.Require().NoError(db.Close())
+
+	fail := true
+	schema.DefineUpgrade(2, `ALTER TABLE t ADD COLUMN bar TEXT;`)
+	schema.DefineUpgrade(3, `ALTER TABLE t ADD COLUMN baz TEXT;`)
+	schema.DefinePostUpgrade(3, func(tx sqlx.Ext) error {
+		if fail {
+			return fmt.Errorf("hook failed")
+		}
+		return nil
+	})
+	schema.DefineUpgrade(4, `CREATE TABLE u ( foo TEXT );`)
+
+	_, err = Open(options)
+	suite.Require().EqualError(err, "error during v3 post-upgrade hook: hook failed")
+
+	sq := openRaw(suite.T(), suite.DBFile)
+	userVersion, err := (&SqliteVersion{}).GetUserVersion(sq)
+	suite.Require().NoError(err)
+	suite.Require().Equal(int32(2), userVersion, "v2 should have been committed before v3 failed")
+	_, err = sq.Exec(`INSERT INTO t (foo, bar) VALUES (?, ?)`, "foo", "bar")
+	suite.Require().NoError(err)
+	_, err = sq.Exec(`INSERT INTO t (baz) VALUES (?)`, "baz")
+	suite.Require().Error(err, "v3 should have been rolled back")
+	suite.Require().NoError(sq.Close())
+
+	fail = false
+	db, err = Open(options)
+	suite.Require().NoError(err)
+	defer db.Close()
+
+	userVersion, err = (&SqliteVersion{}).GetUserVersion(db.Handle())
+	suite.Require().NoError(err)
+	suite.Require().Equal(int32(4), userVersion)
+
+	history, err := MigrationHistory(db.Handle())
+	suite.Require().NoError(err)
+	suite.Require().Len(history, 4)
+}
+
+func (suite *DBTestSuite) TestStepwiseUpgradeBackup() {
+	schema := NewSqlSchema(`CREATE TABLE t ( foo TEXT )`)
+	options := OpenOptions{
+		File:            suite.DBFile,
+		Schema:          schema,
+		DriverName:      "sqlite",
+		BackupDir:       filepath.Join(filepath.Dir(suite.DBFile), "backups"),
+		StepwiseUpgrade: true,
+	}
+
+	db, err := Open(options)
+	suite.Require().NoError(err)
+	suite.Require().NoError(db.Close())
+
+	fail := true
+	schema.DefineUpgrade(2, `ALTER TABLE t ADD COLUMN bar TEXT;`)
+	schema.DefineUpgrade(3, `ALTER TABLE t ADD COLUMN baz TEXT;`)
+	schema.DefinePostUpgrade(3, func(tx sqlx.Ext) error {
+		if fail {
+			return fmt.Errorf("hook failed")
+		}
+		return nil
+	})
+
+	_, err = Open(options)
+	suite.Require().EqualError(err, "error during v3 post-upgrade hook: hook failed")
+	suite.Require().FileExists(filepath.Join(options.BackupDir, "test.before_v3_upgrade_from_v1.db"))
+
+	// Resuming from v2 takes a backup of its own
+	fail = false
+	p, err := Plan(options)
+	suite.Require().NoError(err)
+	suite.Require().NoError(p.Err)
+	suite.Require().Equal(filepath.Join(options.BackupDir, "test.before_v3_upgrade_from_v2.db"), p.Backup)
+
+	db, err = Open(options)
+	suite.Require().NoError(err)
+	defer db.Close()
+
+	userVersion, err := (&SqliteVersion{}).GetUserVersion(db.Handle())
+	suite.Require().NoError(err)
+	suite.Require().Equal(int32(3), userVersion)
+	suite.Require().ElementsMatch([]string{
+		"test.before_v3_upgrade_from_v1.db",
+		"test.before_v3_upgrade_from_v2.db",
+	}, backupNames(suite.T(), options))
+}
+
+func (suite *DBTestSuite) TestNoTxUpgrade() {
+	schema := NewSqlSchema(`CREATE TABLE t ( foo TEXT )`)
+	schema.RecordHistory = true
+	schema.DefineUpgradeNoTx(2, `PRAGMA journal_mode=WAL;`)
+	schema.DefineUpgrade(3, `ALTER TABLE t ADD COLUMN bar TEXT;`)
+	schema.DefineUpgrade(4, `DELETE FROM t;`)
+	schema.DefineUpgradeNoTx(5, `VACUUM;`)
+	options := OpenOptions{File: suite.DBFile, Schema: schema, DriverName: "sqlite"}
+
+	p, err := Plan(options)
+	suite.Require().NoError(err)
+	var noTx []int32
+	for _, step := range p.Steps {
+		if step.NoTx {
+			noTx = append(noTx, step.Version)
+		}
+	}
+	suite.Require().Equal([]int32{2, 5}, noTx)
+
+	db, err := Open(options)
+	suite.Require().NoError(err)
+
+	var journalMode string
+	suite.Require().NoError(sqlx.Get(db.Handle(), &journalMode, `PRAGMA journal_mode`))
+	suite.Require().Equal("wal", journalMode)
+	userVersion, err := (&SqliteVersion{}).GetUserVersion(db.Handle())
+	suite.Require().NoError(err)
+	suite.Require().Equal(int32(5), userVersion)
+	history, err := MigrationHistory(db.Handle())
+	suite.Require().NoError(err)
+	suite.Require().Len(history, 5)
+
+	diff, err := db.VerifySchema()
+	suite.Require().NoError(err)
+	suite.Require().True(diff.Empty(), diff.String())
+	suite.Require().NoError(db.Close())
+
+	schema.DefineUpgrade(6, `CREATE TABLE u ( foo TEXT );`)
+	schema.DefineUpgradeNoTx(7, `NOT SQL;`)
+	_, err = Open(options)
+	suite.Require().ErrorContains(err, "error during v7 schema upgrade")
+
+	sq := openRaw(suite.T(), suite.DBFile)
+	userVersion, err = (&SqliteVersion{}).GetUserVersion(sq)
+	suite.Require().NoError(err)
+	suite.Require().Equal(int32(6), userVersion, "v6 should have been committed before v7 ran")
+}
+
+func (suite *DBTestSuite) TestUpgradeFunc() {
+	schema := NewSqlSchema(`CREATE TABLE t ( name TEXT )`)
+	schema.RecordHistory = true
+	schema.DefineUpgrade(2, `ALTER TABLE t ADD COLUMN first TEXT; ALTER TABLE t ADD COLUMN last TEXT;`)
+	options := OpenOptions{File: suite.DBFile, Schema: schema, DriverName: "sqlite"}
+
+	db, err := Open(options)
+	suite.Require().NoError(err)
+	_, err = db.Handle().Exec(`INSERT INTO t (name) VALUES (?), (?)`, "Ada Lovelace", "Alan Turing")
+	suite.Require().NoError(err)
+	suite.Require().NoError(db.Close())
+
+	schema.DefineUpgradeFunc(3, func(tx Handle) error {
+		var names []string
+		if err := sqlx.Select(tx, &names, `SELECT name FROM t`); err != nil {
+			return err
+		}
+		stmt, err := tx.Preparex(`UPDATE t SET first = ?, last = ? WHERE name = ?`)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		for _, name := range names {
+			first, last, _ := strings.Cut(name, " ")
+			if _, err := stmt.Exec(first, last, name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	schema.DefineUpgrade(4, `ALTER TABLE t DROP COLUMN name;`)
+
+	p, err := Plan(options)
+	suite.Require().NoError(err)
+	suite.Require().Len(p.Steps, 2)
+	suite.Require().True(p.Steps[0].Func)
+	suite.Require().Empty(p.Steps[0].SQL)
+	suite.Require().False(p.Steps[1].Func)
+
+	db, err = Open(options)
+	suite.Require().NoError(err)
+	defer db.Close()
+
+	var lasts []string
+	suite.Require().NoError(sqlx.Select(db.Handle(), &lasts, `SELECT last FROM t ORDER BY first`))
+	suite.Require().Equal([]string{"Lovelace", "Turing"}, lasts)
+
+	history, err := MigrationHistory(db.Handle())
+	suite.Require().NoError(err)
+	suite.Require().Len(history, 4)
+
+	diff, err := db.VerifySchema()
+	suite.Require().NoError(err)
+	suite.Require().True(diff.Empty(), diff.String())
+}
+
+func (suite *DBTestSuite) TestDowngrade() {
+	root := `CREATE TABLE t ( foo TEXT )`
+	newer := NewSqlSchema(root)
+	newer.DefineUpgrade(2, `ALTER TABLE t ADD COLUMN bar TEXT;`)
+	newer.DefineUpgrade(3, `CREATE TABLE u ( baz TEXT );`)
+
+	db, err := Open(OpenOptions{File: suite.DBFile, Schema: newer, DriverName: "sqlite"})
+	suite.Require().NoError(err)
+	suite.Require().NoError(db.Close())
+
+	older := NewSqlSchema(root)
+	older.DefineUpgrade(2, `ALTER TABLE t ADD COLUMN bar TEXT;`)
+
+	_, err = Open(OpenOptions{File: suite.DBFile, Schema: older, DriverName: "sqlite"})
+	suite.Require().EqualError(err, "user_version (3) is higher than the schema version (2)")
+
+	_, err = Open(OpenOptions{File: suite.DBFile, Schema: older, DriverName: "sqlite", AllowDowngrade: true})
+	suite.Require().EqualError(err, "no downgrade defined for v3")
+
+	var order []string
+	older.DefineDowngrade(3, `DROP TABLE u;`)
+	older.DefinePreDowngrade(3, func(tx sqlx.Ext) error {
+		order = append(order, "pre")
+		return nil
+	})
+	older.DefinePostDowngrade(3, func(tx sqlx.Ext) error {
+		order = append(order, "post")
+		return nil
+	})
+
+	backupDir := filepath.Dir(suite.DBFile)
+	db, err = Open(OpenOptions{File: suite.DBFile, Schema: older, DriverName: "sqlite", AllowDowngrade: true, BackupDir: backupDir})
+	suite.Require().NoError(err)
+	suite.Require().Equal([]string{"pre", "post"}, order)
+	suite.Require().FileExists(filepath.Join(backupDir, "test.before_v2_downgrade.db"))
+
+	userVersion, err := (&SqliteVersion{}).GetUserVersion(db.Handle())
+	suite.Require().NoError(err)
+	suite.Require().Equal(int32(2), userVersion)
+
+	var count int
+	suite.Require().NoError(sqlx.Get(db.Handle(), &count, `SELECT COUNT(*) FROM sqlite_master WHERE name = 'u'`))
+	suite.Require().Zero(count)
+	suite.Require().NoError(db.Close())
+
+	// The newer binary can upgrade again afterwards
+	db, err = Open(OpenOptions{File: suite.DBFile, Schema: newer, DriverName: "sqlite"})
+	suite.Require().NoError(err)
+	suite.Require().NoError(db.Close())
+}
+
 func (suite *DBTestSuite) TestBackupBehavior() {
 	schema := NewSqlSchema(`CREATE TABLE t ( foo TEXT, bar NUMERIC )`)
 	schema.DefineUpgrade(2, `
@@ -326,6 +632,150 @@ ALTER TABLE p ADD COLUMN extra TEXT;
 	suite.Require().Equal(1, legacy.FallbackReader.(*mockReader).callVersion)
 }
 
+func (suite *DBTestSuite) TestDefineLegacy() {
+	legacyDB, err := sqlx.Open("sqlite", fmt.Sprintf("file:%s", suite.DBFile))
+	suite.Require().NoError(err)
+	_, err = legacyDB.Exec(`CREATE TABLE p (foo TEXT, bar NUMERIC, extra TEXT ); INSERT INTO p (foo) VALUES ('legacy');`)
+	suite.Require().NoError(err)
+	suite.Require().NoError(legacyDB.Close())
+
+	newSchema := func() *SqlSchema {
+		schema := NewSqlSchema(`CREATE TABLE t ( foo TEXT, bar NUMERIC )`)
+		schema.DefineUpgrade(2, `
+ALTER TABLE t RENAME TO p;
+ALTER TABLE p ADD COLUMN extra TEXT;
+`)
+		return schema
+	}
+
+	var calls int
+	legacy := func(schema *SqlSchema) SchemaLegacyHelper {
+		return func(q sqlx.Queryer) (int32, int32, error) {
+			calls++
+			exists, err := tableExists(q, "p")
+			if err != nil || !exists {
+				return 0, 0, err
+			}
+			return schema.ApplicationID(), 2, nil
+		}
+	}
+
+	// A legacy database at the latest version is adopted as-is
+	schema := newSchema()
+	schema.DefineLegacy(legacy(schema))
+	options := OpenOptions{File: suite.DBFile, Schema: schema, DriverName: "sqlite", BackupDir: filepath.Join(filepath.Dir(suite.DBFile), "backups")}
+
+	p, err := Plan(options)
+	suite.Require().NoError(err)
+	suite.Require().NoError(p.Err)
+	suite.Require().Equal(PlanAdopt, p.Action)
+	suite.Require().True(p.Legacy)
+	suite.Require().Empty(p.Steps)
+
+	db, err := Open(options)
+	suite.Require().NoError(err)
+	suite.Require().NoError(db.Close())
+
+	// Once adopted, the helper is no longer consulted
+	calls = 0
+	schema = newSchema()
+	schema.DefineLegacy(legacy(schema))
+	schema.DefineUpgrade(3, `ALTER TABLE p ADD COLUMN more TEXT`)
+	options.Schema = schema
+	db, err = Open(options)
+	suite.Require().NoError(err)
+	suite.Require().Zero(calls)
+
+	var foo string
+	suite.Require().NoError(sqlx.Get(db.Handle(), &foo, `SELECT foo FROM p WHERE more IS NULL`))
+	suite.Require().Equal("legacy", foo)
+	userVersion, err := (&SqliteVersion{}).GetUserVersion(db.Handle())
+	suite.Require().NoError(err)
+	suite.Require().Equal(int32(3), userVersion)
+	suite.Require().NoError(db.Close())
+	suite.Require().FileExists(filepath.Join(options.BackupDir, "test.before_v3_upgrade.db"))
+
+	// A new database is initialized normally
+	empty := filepath.Join(filepath.Dir(suite.DBFile), "empty.db")
+	db, err = Open(OpenOptions{File: empty, Schema: schema, DriverName: "sqlite"})
+	suite.Require().NoError(err)
+	suite.Require().Equal(1, calls)
+	suite.Require().NoError(db.Close())
+
+	// A legacy database for another application is rejected
+	other := filepath.Join(filepath.Dir(suite.DBFile), "other.db")
+	legacyDB, err = sqlx.Open("sqlite", fmt.Sprintf("file:%s", other))
+	suite.Require().NoError(err)
+	_, err = legacyDB.Exec(`CREATE TABLE p ( foo TEXT )`)
+	suite.Require().NoError(err)
+	suite.Require().NoError(legacyDB.Close())
+
+	otherSchema := newSchema()
+	otherSchema.DefineLegacy(func(q sqlx.Queryer) (int32, int32, error) {
+		return 1234, 1, nil
+	})
+	_, err = Open(OpenOptions{File: other, Schema: otherSchema, DriverName: "sqlite"})
+	suite.Require().ErrorContains(err, "legacy application_id (1234) does not match")
+
+	// A legacy database newer than the schema is downgraded and adopted
+	newer := filepath.Join(filepath.Dir(suite.DBFile), "newer.db")
+	legacyDB, err = sqlx.Open("sqlite", fmt.Sprintf("file:%s", newer))
+	suite.Require().NoError(err)
+	_, err = legacyDB.Exec(`CREATE TABLE p ( foo TEXT, bar NUMERIC, extra TEXT, more TEXT )`)
+	suite.Require().NoError(err)
+	suite.Require().NoError(legacyDB.Close())
+
+	calls = 0
+	older := newSchema()
+	older.DefineLegacy(func(q sqlx.Queryer) (int32, int32, error) {
+		calls++
+		return older.ApplicationID(), 3, nil
+	})
+	older.DefineDowngrade(3, `ALTER TABLE p DROP COLUMN more;`)
+	newerOptions := OpenOptions{File: newer, Schema: older, DriverName: "sqlite", AllowDowngrade: true}
+	db, err = Open(newerOptions)
+	suite.Require().NoError(err)
+	appId, err := (&SqliteVersion{}).GetApplicationId(db.Handle())
+	suite.Require().NoError(err)
+	suite.Require().Equal(older.ApplicationID(), appId)
+	suite.Require().NoError(db.Close())
+
+	db, err = Open(newerOptions)
+	suite.Require().NoError(err)
+	suite.Require().NoError(db.Close())
+	suite.Require().Equal(1, calls, "a downgraded legacy database should not be detected again")
+}
+
+func (suite *DBTestSuite) TestSchemaVersionStorer() {
+	schema := NewSqlSchema(`CREATE TABLE t ( foo TEXT )`)
+	fromSchema := &countingStorer{}
+	schema.VersionStorer = fromSchema
+	suite.Require().Same(fromSchema, schema.Copy().(*SqlSchema).VersionStorer)
+
+	db, err := Open(OpenOptions{File: suite.DBFile, Schema: schema, DriverName: "sqlite"})
+	suite.Require().NoError(err)
+	suite.Require().NoError(db.Close())
+	suite.Require().NotZero(fromSchema.calls)
+
+	fromOptions := &countingStorer{}
+	fromSchema.calls = 0
+	db, err = Open(OpenOptions{File: suite.DBFile, Schema: schema, DriverName: "sqlite", VersionStorer: fromOptions})
+	suite.Require().NoError(err)
+	suite.Require().NoError(db.Close())
+	suite.Require().NotZero(fromOptions.calls)
+	suite.Require().Zero(fromSchema.calls, "OpenOptions.VersionStorer should take precedence")
+}
+
+type countingStorer struct {
+	SqliteVersion
+	calls int
+}
+
+func (c *countingStorer) GetApplicationId(tx sqlx.Queryer) (int32, error) {
+	c.calls++
+	return c.SqliteVersion.GetApplicationId(tx)
+}
+
 type mockReader struct {
 	ID                     int32
 	callAppId, callVersion int
@@ -0,0 +1,167 @@
+package localdb
+
+import (
+	"fmt"
+	"hash/crc32"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// migrationsTable records each applied SqlSchema version when
+// SqlSchema.RecordHistory is enabled.
+const migrationsTable = "localdb_migrations"
+
+// Verifier is an optional interface for a Schema that can check
+// an existing database for consistency before Open upgrades it.
+// If Verify returns an error, Open closes the database and
+// returns the error.
+type Verifier interface {
+	Verify(q sqlx.Queryer, currentVersion int32) error
+}
+
+// MigrationRecord describes one applied version, as recorded
+// in the localdb_migrations table.
+type MigrationRecord struct {
+	Version int32
+
+	// Checksum is the CRC32C of the version's SQL at the time
+	// it was applied.
+	Checksum uint32
+
+	AppliedAt time.Time
+
+	// Duration includes the version's SQL and any upgrade hooks.
+	Duration time.Duration
+}
+
+// ChecksumMismatch describes a version whose SQL has changed
+// since it was applied.
+type ChecksumMismatch struct {
+	Version int32
+
+	// Applied is the checksum recorded when the version was applied.
+	Applied uint32
+
+	// Defined is the checksum of the version's current SQL.
+	Defined uint32
+}
+
+// ChecksumMismatchError is returned by Open when the SQL of one
+// or more previously applied versions no longer matches what
+// was recorded in the migration history.
+type ChecksumMismatchError struct {
+	Mismatches []ChecksumMismatch
+}
+
+func (e *ChecksumMismatchError) Error() string {
+	parts := make([]string, len(e.Mismatches))
+	for i, m := range e.Mismatches {
+		parts[i] = fmt.Sprintf("v%d (applied %08x, defined %08x)", m.Version, m.Applied, m.Defined)
+	}
+	return "schema checksum mismatch: " + strings.Join(parts, ", ")
+}
+
+func checksum(sql string) uint32 {
+	return crc32.Checksum([]byte(sql), crc32cTable)
+}
+
+func tableExists(q sqlx.Queryer, name string) (bool, error) {
+	var count int
+	if err := sqlx.Get(q, &count, `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`, name); err != nil {
+		return false, err
+	}
+	return count != 0, nil
+}
+
+func createMigrationsTable(tx sqlx.Execer) error {
+	_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS ` + migrationsTable + ` (
+	version INTEGER PRIMARY KEY,
+	checksum INTEGER NOT NULL,
+	applied_at TEXT NOT NULL,
+	duration_ns INTEGER NOT NULL
+)`)
+	return err
+}
+
+func recordMigration(tx sqlx.Execer, version int, sql string, started time.Time) error {
+	_, err := tx.Exec(`INSERT OR REPLACE INTO `+migrationsTable+` (version, checksum, applied_at, duration_ns) VALUES (?, ?, ?, ?)`,
+		version, checksum(sql), started.UTC().Format(time.RFC3339Nano), time.Since(started).Nanoseconds())
+	return err
+}
+
+func forgetMigration(tx sqlx.Execer, version int) error {
+	_, err := tx.Exec(`DELETE FROM `+migrationsTable+` WHERE version = ?`, version)
+	return err
+}
+
+// MigrationHistory returns the contents of the localdb_migrations
+// table, ordered by version. If the table does not exist,
+// MigrationHistory returns an empty slice.
+func MigrationHistory(q sqlx.Queryer) ([]MigrationRecord, error) {
+	exists, err := tableExists(q, migrationsTable)
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	var rows []struct {
+		Version    int32  `db:"version"`
+		Checksum   int64  `db:"checksum"`
+		AppliedAt  string `db:"applied_at"`
+		DurationNs int64  `db:"duration_ns"`
+	}
+	if err = sqlx.Select(q, &rows, `SELECT version, checksum, applied_at, duration_ns FROM `+migrationsTable+` ORDER BY version`); err != nil {
+		return nil, err
+	}
+
+	records := make([]MigrationRecord, len(rows))
+	for i, row := range rows {
+		appliedAt, err := time.Parse(time.RFC3339Nano, row.AppliedAt)
+		if err != nil {
+			return nil, fmt.Errorf("invalid applied_at for v%d: %w", row.Version, err)
+		}
+		records[i] = MigrationRecord{
+			Version:   row.Version,
+			Checksum:  uint32(row.Checksum),
+			AppliedAt: appliedAt,
+			Duration:  time.Duration(row.DurationNs),
+		}
+	}
+	return records, nil
+}
+
+// Verify compares the migration history against the SQL currently
+// defined for each version up to currentVersion, returning a
+// *ChecksumMismatchError if any differ. Versions without a history
+// entry (such as those applied before RecordHistory was enabled)
+// are not checked. Verify does nothing unless RecordHistory is set.
+func (s *SqlSchema) Verify(q sqlx.Queryer, currentVersion int32) error {
+	if !s.RecordHistory {
+		return nil
+	}
+
+	history, err := MigrationHistory(q)
+	if err != nil {
+		return err
+	}
+
+	var mismatches []ChecksumMismatch
+	for _, record := range history {
+		if record.Version < 1 || record.Version > currentVersion || record.Version > s.LatestVersion() {
+			continue
+		}
+		if defined := checksum(s.versions[record.Version-1]); defined != record.Checksum {
+			mismatches = append(mismatches, ChecksumMismatch{
+				Version: record.Version,
+				Applied: record.Checksum,
+				Defined: defined,
+			})
+		}
+	}
+
+	if len(mismatches) != 0 {
+		return &ChecksumMismatchError{Mismatches: mismatches}
+	}
+	return nil
+}
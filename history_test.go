@@ -0,0 +1,51 @@
+package localdb
+
+func (suite *DBTestSuite) TestMigrationHistory() {
+	root := `CREATE TABLE t ( foo TEXT )`
+
+	schema := NewSqlSchema(root)
+	schema.RecordHistory = true
+	schema.DefineUpgrade(2, `ALTER TABLE t ADD COLUMN bar TEXT;`)
+
+	db, err := Open(OpenOptions{File: suite.DBFile, Schema: schema, DriverName: "sqlite"})
+	suite.Require().NoError(err)
+
+	history, err := MigrationHistory(db.Handle())
+	suite.Require().NoError(err)
+	suite.Require().Len(history, 2)
+	for i, record := range history {
+		suite.Require().Equal(int32(i+1), record.Version)
+		suite.Require().Equal(checksum(schema.versions[i]), record.Checksum)
+		suite.Require().False(record.AppliedAt.IsZero())
+	}
+	suite.Require().NoError(db.Close())
+
+	// Reopening with unchanged SQL verifies cleanly
+	schema.DefineUpgrade(3, `ALTER TABLE t ADD COLUMN baz TEXT;`)
+	db, err = Open(OpenOptions{File: suite.DBFile, Schema: schema, DriverName: "sqlite"})
+	suite.Require().NoError(err)
+	history, err = MigrationHistory(db.Handle())
+	suite.Require().NoError(err)
+	suite.Require().Len(history, 3)
+	suite.Require().NoError(db.Close())
+
+	edited := NewSqlSchema(root)
+	edited.RecordHistory = true
+	edited.DefineUpgrade(2, `ALTER TABLE t ADD COLUMN bar INTEGER;`)
+	edited.DefineUpgrade(3, `ALTER TABLE t ADD COLUMN baz TEXT;`)
+
+	_, err = Open(OpenOptions{File: suite.DBFile, Schema: edited, DriverName: "sqlite"})
+	var mismatch *ChecksumMismatchError
+	suite.Require().ErrorAs(err, &mismatch)
+	suite.Require().Equal([]ChecksumMismatch{{
+		Version: 2,
+		Applied: checksum(`ALTER TABLE t ADD COLUMN bar TEXT;`),
+		Defined: checksum(`ALTER TABLE t ADD COLUMN bar INTEGER;`),
+	}}, mismatch.Mismatches)
+
+	// Without RecordHistory, the history is neither written nor checked
+	edited.RecordHistory = false
+	db, err = Open(OpenOptions{File: suite.DBFile, Schema: edited, DriverName: "sqlite"})
+	suite.Require().NoError(err)
+	suite.Require().NoError(db.Close())
+}
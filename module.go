@@ -0,0 +1,254 @@
+package localdb
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// modulesTable records the version of each ModuleSchema.
+const modulesTable = "localdb_modules"
+
+// moduleNamePattern matches valid module names, which appear in
+// backup file names.
+const moduleNamePattern = `[A-Za-z0-9_-]+`
+
+var validModuleName = regexp.MustCompile(`^` + moduleNamePattern + `$`)
+
+// ModuleSchema is an independently versioned part of a database,
+// for applications built from modules that each own their tables.
+// See OpenOptions.Modules.
+//
+// A module's application ID and version are recorded in the
+// localdb_modules table, so the Schema's VersionStorer is not used.
+// Modules do not support RecordHistory, downgrades, or
+// DefineUpgradeNoTx.
+type ModuleSchema struct {
+	// Name identifies the module in the localdb_modules table.
+	// Required, and must be unique within OpenOptions.Modules.
+	// Names may contain only ASCII letters, digits, '_' and '-',
+	// as they are also used to name backups.
+	Name string
+
+	// Schema holds the module's versions. Its ApplicationID is
+	// recorded with the module's version, and must not change.
+	Schema *SqlSchema
+
+	// DependsOn names modules that must be upgraded before
+	// this one.
+	DependsOn []string
+}
+
+// ModulePlan describes a module that Open would upgrade.
+type ModulePlan struct {
+	Name           string
+	CurrentVersion int32
+	TargetVersion  int32
+
+	// Steps lists each version that would be applied, in order.
+	Steps []PlanStep
+
+	schema *SqlSchema
+}
+
+func copyModules(modules []ModuleSchema) []ModuleSchema {
+	if len(modules) == 0 {
+		return nil
+	}
+
+	copied := make([]ModuleSchema, len(modules))
+	for i, m := range modules {
+		copied[i] = m
+		if m.Schema != nil {
+			copied[i].Schema = m.Schema.Copy().(*SqlSchema)
+		}
+		copied[i].DependsOn = append([]string(nil), m.DependsOn...)
+	}
+	return copied
+}
+
+// sortModules returns modules in dependency order. Modules that do
+// not depend on each other keep the order they were given in.
+func sortModules(modules []ModuleSchema) ([]ModuleSchema, error) {
+	byName := make(map[string]ModuleSchema, len(modules))
+	for _, m := range modules {
+		if m.Name == "" {
+			return nil, fmt.Errorf("module name is required")
+		}
+		if !validModuleName.MatchString(m.Name) {
+			return nil, fmt.Errorf("module name %q may contain only letters, digits, '_' and '-'", m.Name)
+		}
+		if m.Schema == nil {
+			return nil, fmt.Errorf("module %q has no Schema", m.Name)
+		}
+		if _, ok := byName[m.Name]; ok {
+			return nil, fmt.Errorf("duplicate module %q", m.Name)
+		}
+		byName[m.Name] = m
+	}
+
+	sorted := make([]ModuleSchema, 0, len(modules))
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int, len(modules))
+	var visit func(m ModuleSchema, path []string) error
+	visit = func(m ModuleSchema, path []string) error {
+		switch state[m.Name] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("module dependency cycle: %v", append(path, m.Name))
+		}
+		state[m.Name] = visiting
+		for _, dep := range m.DependsOn {
+			d, ok := byName[dep]
+			if !ok {
+				return fmt.Errorf("module %q depends on unknown module %q", m.Name, dep)
+			}
+			if err := visit(d, append(path, m.Name)); err != nil {
+				return err
+			}
+		}
+		state[m.Name] = visited
+		sorted = append(sorted, m)
+		return nil
+	}
+
+	for _, m := range modules {
+		if err := visit(m, nil); err != nil {
+			return nil, err
+		}
+	}
+	return sorted, nil
+}
+
+// planModules returns the modules that need upgrading, in
+// dependency order. If q is nil, the database is assumed not
+// to exist yet.
+func planModules(q sqlx.Queryer, modules []ModuleSchema) ([]ModulePlan, error) {
+	if len(modules) == 0 {
+		return nil, nil
+	}
+
+	sorted, err := sortModules(modules)
+	if err != nil {
+		return nil, err
+	}
+
+	var versions map[string]moduleVersion
+	if q != nil {
+		if versions, err = readModuleVersions(q); err != nil {
+			return nil, err
+		}
+	}
+
+	var plans []ModulePlan
+	for _, m := range sorted {
+		schema := m.Schema
+		if schema.RecordHistory {
+			return nil, fmt.Errorf("module %q: RecordHistory is not supported for modules", m.Name)
+		}
+
+		current, ok := versions[m.Name]
+		if ok && current.ApplicationID != schema.ApplicationID() {
+			return nil, fmt.Errorf("module %q: application_id (%d) does not match schema ID (%d)", m.Name, current.ApplicationID, schema.ApplicationID())
+		}
+		if current.Version > schema.LatestVersion() {
+			return nil, fmt.Errorf("module %q: version (%d) is higher than the schema version (%d)", m.Name, current.Version, schema.LatestVersion())
+		}
+		if current.Version == schema.LatestVersion() {
+			continue
+		}
+
+		steps, err := schema.PlanSteps(current.Version, schema.LatestVersion())
+		if err != nil {
+			return nil, fmt.Errorf("module %q: %w", m.Name, err)
+		}
+		if hasNoTxSteps(steps) {
+			return nil, fmt.Errorf("module %q: non-transactional upgrade steps are not supported for modules", m.Name)
+		}
+
+		plans = append(plans, ModulePlan{
+			Name:           m.Name,
+			CurrentVersion: current.Version,
+			TargetVersion:  schema.LatestVersion(),
+			Steps:          steps,
+			schema:         schema,
+		})
+	}
+	return plans, nil
+}
+
+// upgradeModules applies each module's plan on tx, in order.
+func upgradeModules(tx sqlx.Ext, plans []ModulePlan) error {
+	if len(plans) == 0 {
+		return nil
+	}
+
+	if _, err := tx.Exec(`CREATE TABLE IF NOT EXISTS ` + modulesTable + ` (
+	name TEXT PRIMARY KEY,
+	application_id INTEGER NOT NULL,
+	version INTEGER NOT NULL,
+	updated_at TEXT NOT NULL
+)`); err != nil {
+		return fmt.Errorf("unable to create %s: %w", modulesTable, err)
+	}
+
+	for _, p := range plans {
+		version, err := p.schema.Upgrade(tx, p.CurrentVersion)
+		if err != nil {
+			return fmt.Errorf("module %q: %w", p.Name, err)
+		}
+		if _, err = tx.Exec(`INSERT OR REPLACE INTO `+modulesTable+` (name, application_id, version, updated_at) VALUES (?, ?, ?, ?)`,
+			p.Name, p.schema.ApplicationID(), version, time.Now().UTC().Format(time.RFC3339Nano)); err != nil {
+			return fmt.Errorf("unable to record module %q in %s: %w", p.Name, modulesTable, err)
+		}
+	}
+	return nil
+}
+
+type moduleVersion struct {
+	ApplicationID int32 `db:"application_id"`
+	Version       int32 `db:"version"`
+}
+
+func readModuleVersions(q sqlx.Queryer) (map[string]moduleVersion, error) {
+	exists, err := tableExists(q, modulesTable)
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	var rows []struct {
+		Name string `db:"name"`
+		moduleVersion
+	}
+	if err = sqlx.Select(q, &rows, `SELECT name, application_id, version FROM `+modulesTable); err != nil {
+		return nil, err
+	}
+
+	versions := make(map[string]moduleVersion, len(rows))
+	for _, row := range rows {
+		versions[row.Name] = row.moduleVersion
+	}
+	return versions, nil
+}
+
+// ModuleVersions returns the version of each module recorded in
+// the localdb_modules table. If the table does not exist,
+// ModuleVersions returns an empty map.
+func ModuleVersions(q sqlx.Queryer) (map[string]int32, error) {
+	rows, err := readModuleVersions(q)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make(map[string]int32, len(rows))
+	for name, row := range rows {
+		versions[name] = row.Version
+	}
+	return versions, nil
+}
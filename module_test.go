@@ -0,0 +1,203 @@
+package localdb
+
+import (
+	"path/filepath"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func (suite *DBTestSuite) TestModules() {
+	schema := NewSqlSchema(`CREATE TABLE t ( foo TEXT )`)
+	users := NewSqlSchema(`CREATE TABLE users ( name TEXT )`)
+	audit := NewSqlSchema(`CREATE TABLE audit ( event TEXT );
+INSERT INTO audit SELECT 'created ' || name FROM users;`)
+
+	// audit is listed first, but must run after users
+	modules := []ModuleSchema{
+		{Name: "audit", Schema: audit, DependsOn: []string{"users"}},
+		{Name: "users", Schema: users},
+	}
+	db, err := Open(OpenOptions{File: suite.DBFile, Schema: schema, DriverName: "sqlite", Modules: modules})
+	suite.Require().NoError(err)
+
+	versions, err := ModuleVersions(db.Handle())
+	suite.Require().NoError(err)
+	suite.Require().Equal(map[string]int32{"users": 1, "audit": 1}, versions)
+	suite.Require().NoError(db.Close())
+
+	// Only the module changes
+	users.DefineUpgrade(2, `ALTER TABLE users ADD COLUMN email TEXT;`)
+	p, err := Plan(OpenOptions{File: suite.DBFile, Schema: schema, DriverName: "sqlite", Modules: modules})
+	suite.Require().NoError(err)
+	suite.Require().NoError(p.Err)
+	suite.Require().Equal(PlanNone, p.Action)
+	suite.Require().Len(p.Modules, 1)
+	suite.Require().Equal("users", p.Modules[0].Name)
+	suite.Require().Equal(int32(1), p.Modules[0].CurrentVersion)
+	suite.Require().Equal(int32(2), p.Modules[0].TargetVersion)
+
+	db, err = Open(OpenOptions{File: suite.DBFile, Schema: schema, DriverName: "sqlite", Modules: modules})
+	suite.Require().NoError(err)
+	defer db.Close()
+
+	versions, err = ModuleVersions(db.Handle())
+	suite.Require().NoError(err)
+	suite.Require().Equal(map[string]int32{"users": 2, "audit": 1}, versions)
+
+	userVersion, err := (&SqliteVersion{}).GetUserVersion(db.Handle())
+	suite.Require().NoError(err)
+	suite.Require().Equal(int32(1), userVersion, "the main schema should not change")
+
+	diff, err := db.VerifySchema()
+	suite.Require().NoError(err)
+	suite.Require().True(diff.Empty(), diff.String())
+}
+
+func (suite *DBTestSuite) TestModuleUpgradeAtomic() {
+	schema := NewSqlSchema(`CREATE TABLE t ( foo TEXT )`)
+	good := NewSqlSchema(`CREATE TABLE good ( foo TEXT )`)
+	bad := NewSqlSchema(`CREATE TABLE bad ( foo TEXT )`)
+	bad.DefineUpgrade(2, `INSERT INTO missing VALUES (1);`)
+
+	_, err := Open(OpenOptions{File: suite.DBFile, Schema: schema, DriverName: "sqlite", Modules: []ModuleSchema{
+		{Name: "good", Schema: good},
+		{Name: "bad", Schema: bad},
+	}})
+	suite.Require().ErrorContains(err, `module "bad"`)
+
+	sq := openRaw(suite.T(), suite.DBFile)
+	versions, err := ModuleVersions(sq)
+	suite.Require().NoError(err)
+	suite.Require().Empty(versions)
+
+	exists, err := tableExists(sq, "good")
+	suite.Require().NoError(err)
+	suite.Require().False(exists, "the upgrade transaction should be rolled back")
+}
+
+func (suite *DBTestSuite) TestModuleRollsBackSchema() {
+	bad := NewSqlSchema(`INSERT INTO missing VALUES (1);`)
+	modules := []ModuleSchema{{Name: "bad", Schema: bad}}
+	userVersion := func(file string) int32 {
+		v, err := (&SqliteVersion{}).GetUserVersion(openRaw(suite.T(), file))
+		suite.Require().NoError(err)
+		return v
+	}
+
+	// Downgrades
+	file := suite.DBFile
+	newer := NewSqlSchema(`CREATE TABLE t ( foo TEXT )`)
+	newer.DefineUpgrade(2, `ALTER TABLE t ADD COLUMN bar TEXT;`)
+	db, err := Open(OpenOptions{File: file, Schema: newer, DriverName: "sqlite"})
+	suite.Require().NoError(err)
+	suite.Require().NoError(db.Close())
+
+	older := NewSqlSchema(`CREATE TABLE t ( foo TEXT )`)
+	older.DefineDowngrade(2, `ALTER TABLE t DROP COLUMN bar;`)
+	_, err = Open(OpenOptions{File: file, Schema: older, DriverName: "sqlite", AllowDowngrade: true, Modules: modules})
+	suite.Require().ErrorContains(err, `module "bad"`)
+	suite.Require().Equal(int32(2), userVersion(file), "the downgrade should be rolled back")
+
+	// Stepwise upgrades keep the earlier steps
+	file = filepath.Join(suite.T().TempDir(), "test.db")
+	newer.DefineUpgrade(3, `ALTER TABLE t ADD COLUMN baz TEXT;`)
+	_, err = Open(OpenOptions{File: file, Schema: newer, DriverName: "sqlite", StepwiseUpgrade: true, Modules: modules})
+	suite.Require().ErrorContains(err, `module "bad"`)
+	suite.Require().Equal(int32(2), userVersion(file), "the last step should be rolled back")
+}
+
+func (suite *DBTestSuite) TestModuleBackup() {
+	dir := filepath.Dir(suite.DBFile)
+	schema := NewSqlSchema(`CREATE TABLE t ( foo TEXT )`)
+	users := NewSqlSchema(`CREATE TABLE users ( name TEXT )`)
+	options := OpenOptions{
+		File:             suite.DBFile,
+		Schema:           schema,
+		DriverName:       "sqlite",
+		BackupDir:        filepath.Join(dir, "backups"),
+		RestoreOnFailure: true,
+		Modules:          []ModuleSchema{{Name: "users", Schema: users}},
+	}
+
+	db, err := Open(options)
+	suite.Require().NoError(err)
+	suite.Require().NoError(db.Close())
+	suite.Require().NoDirExists(options.BackupDir, "new databases are not backed up")
+
+	users.DefineUpgrade(2, `ALTER TABLE users ADD COLUMN email TEXT;`)
+	p, err := Plan(options)
+	suite.Require().NoError(err)
+	suite.Require().Equal(filepath.Join(options.BackupDir, "test.before_users_v2_upgrade.db"), p.Backup)
+
+	db, err = Open(options)
+	suite.Require().NoError(err)
+	suite.Require().NoError(db.Close())
+	suite.Require().FileExists(p.Backup)
+	suite.Require().Equal([]string{"test.before_users_v2_upgrade.db"}, backupNames(suite.T(), options))
+
+	users.DefineUpgrade(3, `INSERT INTO missing VALUES (1);`)
+	_, err = Open(options)
+	var restoreErr *RestoreError
+	suite.Require().ErrorAs(err, &restoreErr)
+	suite.Require().NoError(restoreErr.RestoreErr)
+	suite.Require().Equal(filepath.Join(options.BackupDir, "test.before_users_v3_upgrade.db"), restoreErr.Backup)
+
+	_, err = Open(OpenOptions{File: options.File, Schema: schema, DriverName: "sqlite", Modules: []ModuleSchema{
+		{Name: "../users", Schema: users},
+	}})
+	suite.Require().ErrorContains(err, "may contain only")
+}
+
+func (suite *DBTestSuite) TestModuleErrors() {
+	schema := NewSqlSchema(`CREATE TABLE t ( foo TEXT )`)
+	a := NewSqlSchema(`CREATE TABLE a ( foo TEXT )`)
+	b := NewSqlSchema(`CREATE TABLE b ( foo TEXT )`)
+
+	open := func(modules ...ModuleSchema) error {
+		db, err := Open(OpenOptions{File: suite.DBFile, Schema: schema, DriverName: "sqlite", Modules: modules})
+		if err == nil {
+			suite.Require().NoError(db.Close())
+		}
+		return err
+	}
+
+	suite.Require().ErrorContains(open(
+		ModuleSchema{Name: "a", Schema: a, DependsOn: []string{"b"}},
+		ModuleSchema{Name: "b", Schema: b, DependsOn: []string{"a"}},
+	), "cycle")
+	suite.Require().ErrorContains(open(ModuleSchema{Name: "a", Schema: a, DependsOn: []string{"c"}}), `unknown module "c"`)
+	suite.Require().ErrorContains(open(ModuleSchema{Name: "a", Schema: a}, ModuleSchema{Name: "a", Schema: b}), "duplicate")
+
+	suite.Require().NoError(open(ModuleSchema{Name: "a", Schema: a}))
+	suite.Require().ErrorContains(open(ModuleSchema{Name: "a", Schema: b}), "does not match schema ID")
+
+	sq := openRaw(suite.T(), suite.DBFile)
+	_, err := sq.Exec(`UPDATE localdb_modules SET version = 5 WHERE name = 'a'`)
+	suite.Require().NoError(err)
+	suite.Require().ErrorContains(open(ModuleSchema{Name: "a", Schema: a}), "higher than the schema version")
+}
+
+func (suite *DBTestSuite) TestModuleUpgradeWithSchema() {
+	schema := NewSqlSchema(`CREATE TABLE t ( foo TEXT )`)
+	m := NewSqlSchema(`CREATE TABLE m ( foo TEXT )`)
+
+	// Module steps can rely on the main schema's new version
+	schema.DefineUpgrade(2, `ALTER TABLE t ADD COLUMN bar TEXT;`)
+	m.DefineUpgrade(2, `INSERT INTO t (bar) VALUES ('from m');`)
+	for _, stepwise := range []bool{false, true} {
+		file := filepath.Join(suite.T().TempDir(), "test.db")
+		db, err := Open(OpenOptions{File: file, Schema: NewSqlSchema(`CREATE TABLE t ( foo TEXT )`), DriverName: "sqlite"})
+		suite.Require().NoError(err)
+		suite.Require().NoError(db.Close())
+
+		db, err = Open(OpenOptions{File: file, Schema: schema, DriverName: "sqlite", StepwiseUpgrade: stepwise, Modules: []ModuleSchema{
+			{Name: "m", Schema: m},
+		}})
+		suite.Require().NoError(err, "stepwise=%v", stepwise)
+
+		var bar []string
+		suite.Require().NoError(sqlx.Select(db.Handle(), &bar, `SELECT bar FROM t`))
+		suite.Require().Equal([]string{"from m"}, bar)
+		suite.Require().NoError(db.Close())
+	}
+}
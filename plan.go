@@ -0,0 +1,320 @@
+package localdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// PlanAction describes what Open would do to a database.
+type PlanAction int
+
+const (
+	// PlanNone means the database is already at the schema's
+	// latest version, or Open would fail (see UpgradePlan.Err).
+	// Modules may still need upgrading (see UpgradePlan.Modules).
+	PlanNone PlanAction = iota
+
+	// PlanInitialize means the database is new (or empty), and
+	// every version of the schema would be applied.
+	PlanInitialize
+
+	// PlanUpgrade means the database would be upgraded from
+	// its current version.
+	PlanUpgrade
+
+	// PlanDowngrade means the database would be rolled back to
+	// the schema's latest version (see OpenOptions.AllowDowngrade).
+	PlanDowngrade
+
+	// PlanAdopt means the database predates localdb and already
+	// matches the schema's latest version (see SqlSchema.DefineLegacy),
+	// so only its application_id and version would be stored.
+	PlanAdopt
+)
+
+func (a PlanAction) String() string {
+	switch a {
+	case PlanNone:
+		return "none"
+	case PlanInitialize:
+		return "initialize"
+	case PlanUpgrade:
+		return "upgrade"
+	case PlanDowngrade:
+		return "downgrade"
+	case PlanAdopt:
+		return "adopt"
+	default:
+		return "invalid"
+	}
+}
+
+// PlanStep describes a single version that would be applied
+// (or reverted, for downgrades).
+type PlanStep struct {
+	Version int32
+
+	// SQL that would be executed. Empty if the Schema does
+	// not implement Planner, or if Func is true.
+	SQL string
+
+	// Hooks is true if Go hooks are registered for this step.
+	Hooks bool
+
+	// Func is true if the step is implemented in Go
+	// (see SqlSchema.DefineUpgradeFunc) rather than SQL.
+	Func bool
+
+	// NoTx is true if Open applies this step outside of the
+	// upgrade transaction (see SqlSchema.DefineUpgradeNoTx).
+	// A Schema that sets NoTx must also implement StepUpgrader.
+	NoTx bool
+}
+
+// Planner is an optional interface for a Schema that can
+// describe the steps it would run, for use by Plan.
+type Planner interface {
+	// PlanSteps returns the steps needed to move a database from
+	// currentVersion to targetVersion, which may be lower than
+	// currentVersion for downgrades. PlanSteps returns an error
+	// if the schema cannot perform the transition.
+	PlanSteps(currentVersion int32, targetVersion int32) ([]PlanStep, error)
+}
+
+// UpgradePlan describes what Open would do to a database,
+// as returned by Plan.
+type UpgradePlan struct {
+	Action PlanAction
+
+	// ApplicationID and CurrentVersion are the values currently
+	// stored in the database, as read by the VersionStorer, or
+	// as reported by the schema if Legacy is true.
+	ApplicationID  int32
+	CurrentVersion int32
+
+	// Legacy is true if the database had no application_id, and
+	// the schema identified it as a legacy database (see
+	// LegacyAdopter).
+	Legacy bool
+
+	// TargetVersion is the schema's latest version.
+	TargetVersion int32
+
+	// Steps lists each version that would be applied, in order.
+	Steps []PlanStep
+
+	// Backup is the path of the backup file that would be
+	// created before changing the database, if any.
+	Backup string
+
+	// Modules lists the modules that would be upgraded, in
+	// dependency order (see OpenOptions.Modules).
+	Modules []ModulePlan
+
+	// Err is the error that Open would return without changing
+	// the database, such as an application_id mismatch or a
+	// version newer than the schema. If Err is non-nil, Action
+	// is PlanNone and Modules is empty.
+	Err error
+
+	// storedAppID and storedVersion are the values read by the
+	// VersionStorer, which differ from ApplicationID and
+	// CurrentVersion for legacy databases.
+	storedAppID   int32
+	storedVersion int32
+}
+
+// Plan reports what Open would do to the database described by
+// options, without modifying it. The database is opened read-only
+// and the OnOpen hook is not invoked. If File does not exist, the
+// plan is to initialize it.
+//
+// Plan returns an error only if the database could not be
+// inspected; errors that Open would encounter are reported
+// via UpgradePlan.Err.
+func Plan(options OpenOptions) (*UpgradePlan, error) {
+	return PlanContext(context.Background(), options)
+}
+
+// PlanContext is like Plan, but uses ctx for all database activity.
+func PlanContext(ctx context.Context, options OpenOptions) (*UpgradePlan, error) {
+	if options.DriverName == "" {
+		return nil, errors.New("OpenOptions.DriverName is required")
+	}
+
+	vs := versionStorer(options)
+
+	path, _, _ := strings.Cut(options.File, "?")
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return planDB(nil, options, vs)
+	} else if err != nil {
+		return nil, err
+	}
+
+	sq, err := openReader(ctx, options, 1)
+	if err != nil {
+		return nil, err
+	}
+	defer sq.Close()
+
+	return planDB(bindContext(ctx, sq.DriverName(), sq), options, vs)
+}
+
+// planDB determines what initDB should do. If q is nil, the
+// database is assumed not to exist yet.
+func planDB(q sqlx.Queryer, options OpenOptions, vs VersionStorer) (*UpgradePlan, error) {
+	p, err := planSchema(q, options, vs)
+	if err != nil || p.Err != nil {
+		return p, err
+	}
+
+	if p.Modules, p.Err = planModules(q, options.Modules); p.Err == nil &&
+		len(p.Modules) != 0 && p.Backup == "" && options.BackupDir != "" && p.ApplicationID != 0 {
+		// Back up before upgrading modules, even if Schema is unchanged
+		p.Backup = moduleBackupName(options, p.Modules[0])
+		p.Err = checkBackupTarget(options, p.Backup)
+	}
+	if p.Err != nil {
+		p.Action = PlanNone
+		p.Backup = ""
+		p.Steps = nil
+		p.Modules = nil
+	}
+	return p, nil
+}
+
+// planSchema plans the changes to options.Schema.
+func planSchema(q sqlx.Queryer, options OpenOptions, vs VersionStorer) (p *UpgradePlan, err error) {
+	schema := options.Schema
+	p = &UpgradePlan{
+		TargetVersion: schema.LatestVersion(),
+	}
+
+	if q != nil {
+		if p.ApplicationID, err = vs.GetApplicationId(q); err != nil {
+			return nil, err
+		}
+
+		if p.ApplicationID != 0 && p.ApplicationID != schema.ApplicationID() {
+			p.Err = fmt.Errorf("application_id (%d) does not match schema ID (%d)", p.ApplicationID, schema.ApplicationID())
+			return p, nil
+		}
+
+		if p.CurrentVersion, err = vs.GetUserVersion(q); err != nil {
+			return nil, err
+		}
+		p.storedAppID, p.storedVersion = p.ApplicationID, p.CurrentVersion
+
+		if adopter, ok := schema.(LegacyAdopter); ok && p.ApplicationID == 0 {
+			appId, version, err := adopter.AdoptLegacy(q)
+			if err != nil {
+				return nil, fmt.Errorf("unable to inspect legacy database: %w", err)
+			}
+			if version != 0 {
+				if appId != schema.ApplicationID() {
+					p.Err = fmt.Errorf("legacy application_id (%d) does not match schema ID (%d)", appId, schema.ApplicationID())
+					return p, nil
+				}
+				p.ApplicationID = appId
+				p.CurrentVersion = version
+				p.Legacy = true
+			}
+		}
+
+		if verifier, ok := schema.(Verifier); ok && p.ApplicationID != 0 {
+			if p.Err = verifier.Verify(q, p.CurrentVersion); p.Err != nil {
+				return p, nil
+			}
+		}
+	}
+
+	switch {
+	case p.CurrentVersion > p.TargetVersion:
+		if !options.AllowDowngrade {
+			p.Err = fmt.Errorf("user_version (%d) is higher than the schema version (%d)", p.CurrentVersion, p.TargetVersion)
+			return p, nil
+		}
+		if _, ok := schema.(Downgrader); !ok {
+			p.Err = fmt.Errorf("user_version (%d) is higher than the schema version (%d), and the schema does not support downgrades", p.CurrentVersion, p.TargetVersion)
+			return p, nil
+		}
+		p.Action = PlanDowngrade
+		if options.BackupDir != "" {
+			p.Backup = backupName(options, p.TargetVersion, "downgrade")
+		}
+
+	case p.ApplicationID == schema.ApplicationID() && p.CurrentVersion == p.TargetVersion:
+		if !p.Legacy {
+			return p, nil
+		}
+		p.Action = PlanAdopt
+
+	case p.CurrentVersion == 0:
+		p.Action = PlanInitialize
+
+	default:
+		p.Action = PlanUpgrade
+	}
+
+	if planner, ok := schema.(Planner); ok {
+		if p.Steps, p.Err = planner.PlanSteps(p.CurrentVersion, p.TargetVersion); p.Err != nil {
+			p.Action = PlanNone
+			p.Backup = ""
+			p.Steps = nil
+			return p, nil
+		}
+	} else {
+		for v := p.CurrentVersion + 1; v <= p.TargetVersion; v++ {
+			p.Steps = append(p.Steps, PlanStep{Version: v})
+		}
+		for v := p.CurrentVersion; v > p.TargetVersion; v-- {
+			p.Steps = append(p.Steps, PlanStep{Version: v})
+		}
+	}
+
+	if p.Action == PlanUpgrade && options.BackupDir != "" && p.ApplicationID != 0 {
+		if options.StepwiseUpgrade || hasNoTxSteps(p.Steps) {
+			p.Backup = partialBackupFilename(options, schema, p.CurrentVersion)
+		} else {
+			p.Backup = backupFilename(options, schema)
+		}
+	}
+
+	if p.Backup != "" {
+		if p.Err = checkBackupTarget(options, p.Backup); p.Err != nil {
+			p.Action = PlanNone
+			p.Backup = ""
+			p.Steps = nil
+			return p, nil
+		}
+	}
+
+	if _, ok := schema.(StepUpgrader); !ok && (p.Action == PlanInitialize || p.Action == PlanUpgrade) {
+		switch {
+		case options.StepwiseUpgrade:
+			p.Err = errors.New("OpenOptions.StepwiseUpgrade requires a Schema implementing StepUpgrader")
+		case hasNoTxSteps(p.Steps):
+			p.Err = errors.New("non-transactional upgrade steps require a Schema implementing StepUpgrader")
+		}
+		if p.Err != nil {
+			p.Action = PlanNone
+			p.Backup = ""
+			p.Steps = nil
+		}
+	}
+	return p, nil
+}
+
+func hasNoTxSteps(steps []PlanStep) bool {
+	for _, step := range steps {
+		if step.NoTx {
+			return true
+		}
+	}
+	return false
+}
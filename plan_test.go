@@ -0,0 +1,104 @@
+package localdb
+
+import (
+	"net/url"
+	"path/filepath"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func (suite *DBTestSuite) TestPlan() {
+	dir := filepath.Dir(suite.DBFile)
+	root := `CREATE TABLE t ( foo TEXT )`
+	schema := NewSqlSchema(root)
+	options := OpenOptions{File: suite.DBFile, Schema: schema, DriverName: "sqlite", BackupDir: dir}
+
+	p, err := Plan(options)
+	suite.Require().NoError(err)
+	suite.Require().Equal(&UpgradePlan{
+		Action:        PlanInitialize,
+		TargetVersion: 1,
+		Steps:         []PlanStep{{Version: 1, SQL: root}},
+	}, p)
+	suite.Require().NoFileExists(suite.DBFile, "Plan should not create the database")
+
+	db, err := Open(options)
+	suite.Require().NoError(err)
+	suite.Require().NoError(db.Close())
+
+	p, err = Plan(options)
+	suite.Require().NoError(err)
+	suite.Require().Equal(PlanNone, p.Action)
+	suite.Require().NoError(p.Err)
+	suite.Require().Empty(p.Steps)
+
+	schema.DefineUpgrade(2, `ALTER TABLE t ADD COLUMN bar TEXT;`)
+	schema.DefinePostUpgrade(2, func(tx sqlx.Ext) error { return nil })
+	p, err = Plan(options)
+	suite.Require().NoError(err)
+	suite.Require().Equal(&UpgradePlan{
+		Action:         PlanUpgrade,
+		ApplicationID:  schema.ID,
+		CurrentVersion: 1,
+		TargetVersion:  2,
+		Steps:          []PlanStep{{Version: 2, SQL: `ALTER TABLE t ADD COLUMN bar TEXT;`, Hooks: true}},
+		Backup:         filepath.Join(dir, "test.before_v2_upgrade.db"),
+		storedAppID:    schema.ID,
+		storedVersion:  1,
+	}, p)
+	suite.Require().NoFileExists(p.Backup)
+
+	p, err = Plan(OpenOptions{File: suite.DBFile, Schema: NewSqlSchema(`CREATE TABLE other ( foo TEXT )`), DriverName: "sqlite"})
+	suite.Require().NoError(err)
+	suite.Require().Equal(PlanNone, p.Action)
+	suite.Require().ErrorContains(p.Err, "does not match schema ID")
+
+	older := NewSqlSchema(root)
+	db, err = Open(options)
+	suite.Require().NoError(err)
+	suite.Require().NoError(db.Close())
+
+	p, err = Plan(OpenOptions{File: suite.DBFile, Schema: older, DriverName: "sqlite"})
+	suite.Require().NoError(err)
+	suite.Require().EqualError(p.Err, "user_version (2) is higher than the schema version (1)")
+
+	p, err = Plan(OpenOptions{File: suite.DBFile, Schema: older, DriverName: "sqlite", AllowDowngrade: true})
+	suite.Require().NoError(err)
+	suite.Require().EqualError(p.Err, "no downgrade defined for v2")
+
+	older.DefineDowngrade(2, `ALTER TABLE t DROP COLUMN bar;`)
+	p, err = Plan(OpenOptions{File: suite.DBFile, Schema: older, DriverName: "sqlite", AllowDowngrade: true})
+	suite.Require().NoError(err)
+	suite.Require().NoError(p.Err)
+	suite.Require().Equal(PlanDowngrade, p.Action)
+	suite.Require().Equal([]PlanStep{{Version: 2, SQL: `ALTER TABLE t DROP COLUMN bar;`}}, p.Steps)
+}
+
+func (suite *DBTestSuite) TestPlanWAL() {
+	schema := NewSqlSchema(`CREATE TABLE t ( foo TEXT )`)
+	db, err := Open(OpenOptions{File: suite.DBFile, Schema: schema, DriverName: "sqlite"})
+	suite.Require().NoError(err)
+	suite.Require().NoError(db.Close())
+
+	// The database is not in WAL mode yet, which a read-only
+	// connection cannot change
+	schema.DefineUpgrade(2, `ALTER TABLE t ADD COLUMN bar TEXT;`)
+	options := OpenOptions{
+		File:       suite.DBFile,
+		Schema:     schema,
+		DriverName: "sqlite",
+		DSNOptions: url.Values{"_pragma": {"busy_timeout(250)", "journal_mode(wal)"}},
+	}
+	p, err := Plan(options)
+	suite.Require().NoError(err)
+	suite.Require().NoError(p.Err)
+	suite.Require().Equal(PlanUpgrade, p.Action)
+
+	db, err = Open(options)
+	suite.Require().NoError(err)
+	defer db.Close()
+
+	var mode string
+	suite.Require().NoError(sqlx.Get(db.Handle(), &mode, `PRAGMA journal_mode`))
+	suite.Require().Equal("wal", mode)
+}
@@ -0,0 +1,109 @@
+package localdb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// openReader opens File in read-only mode, with up to maxConns
+// connections.
+func openReader(ctx context.Context, options OpenOptions, maxConns int) (*sqlx.DB, error) {
+	dsn, err := readerDSN(options)
+	if err != nil {
+		return nil, fmt.Errorf("error assembling DSN: %w", err)
+	}
+
+	sq, err := sqlx.Open(options.DriverName, fmt.Sprintf("file:%s", dsn))
+	if err != nil {
+		return nil, err
+	}
+	sq.SetMaxOpenConns(maxConns)
+
+	if err = sq.PingContext(ctx); err != nil {
+		sq.Close()
+		return nil, err
+	}
+	return sq, nil
+}
+
+// readerDSN returns File's DSN with mode=ro. Any mode in File
+// or DSNOptions is replaced, rather than leaving the driver to
+// pick between two mode parameters.
+//
+// journal_mode is dropped, as changing it requires write access.
+// A read-only connection uses whatever mode the file is already in.
+func readerDSN(options OpenOptions) (string, error) {
+	path, query, _ := strings.Cut(options.File, "?")
+	dsnOpts, err := url.ParseQuery(query)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse input DSN: %w", err)
+	}
+	for k, vs := range options.DSNOptions {
+		dsnOpts[k] = append(dsnOpts[k], vs...)
+	}
+	dsnOpts.Set("mode", "ro")
+
+	// github.com/mattn/go-sqlite3 spellings
+	dsnOpts.Del("_journal_mode")
+	dsnOpts.Del("_journal")
+
+	if pragmas, ok := dsnOpts["_pragma"]; ok {
+		var kept []string
+		for _, pragma := range pragmas {
+			if !isJournalModePragma(pragma) {
+				kept = append(kept, pragma)
+			}
+		}
+		if len(kept) == 0 {
+			dsnOpts.Del("_pragma")
+		} else {
+			dsnOpts["_pragma"] = kept
+		}
+	}
+
+	return assembleDSN(path, dsnOpts)
+}
+
+// isJournalModePragma reports whether pragma, a modernc.org/sqlite
+// _pragma value such as "journal_mode(wal)", sets journal_mode.
+func isJournalModePragma(pragma string) bool {
+	name, _, _ := strings.Cut(pragma, "(")
+	name, _, _ = strings.Cut(name, "=")
+	return strings.EqualFold(strings.TrimSpace(name), "journal_mode")
+}
+
+// ReadHandle returns a Handle to the read-only connection pool
+// configured by OpenOptions.ReadConns. If no read pool was
+// configured, ReadHandle returns the same Handle as Handle.
+func (d *DB) ReadHandle() Handle {
+	return d.readPool()
+}
+
+func (d *DB) readPool() *sqlx.DB {
+	if d.reader != nil {
+		return d.reader
+	}
+	return d.root
+}
+
+// WrapReadTx is like WrapTx, but runs fn in a read-only
+// transaction on the pool returned by ReadHandle. Reads within
+// fn see a consistent snapshot of the database.
+func (d *DB) WrapReadTx(fn any) error {
+	return d.WrapReadTxContext(context.Background(), fn)
+}
+
+// WrapReadTxContext is like WrapReadTx, but begins the
+// transaction with ctx.
+func (d *DB) WrapReadTxContext(ctx context.Context, fn any) error {
+	f := txFunc(fn)
+
+	return d.retry.withRetry(ctx, func() error {
+		return d.wrapTx(ctx, d.readPool(), &sql.TxOptions{ReadOnly: true}, f)
+	})
+}
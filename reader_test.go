@@ -0,0 +1,64 @@
+package localdb
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func (suite *DBTestSuite) TestReadPool() {
+	schema := NewSqlSchema(`CREATE TABLE t ( foo TEXT )`)
+
+	db, err := Open(OpenOptions{File: suite.DBFile, Schema: schema, DriverName: "sqlite"})
+	suite.Require().NoError(err)
+	suite.Require().Equal(db.Handle(), db.ReadHandle(), "ReadHandle should fall back to the writer pool")
+	suite.Require().NoError(db.Close())
+
+	db, err = Open(OpenOptions{
+		File:       suite.DBFile,
+		Schema:     schema,
+		DriverName: "sqlite",
+		DSNOptions: url.Values{"_pragma": {"journal_mode(wal)"}},
+		ReadConns:  2,
+	})
+	suite.Require().NoError(err)
+	defer db.Close()
+
+	_, err = db.ReadHandle().Exec(`INSERT INTO t (foo) VALUES (?)`, "ro")
+	suite.Require().Error(err, "read pool should be read-only")
+
+	suite.Require().NoError(db.WrapTx(func(tx sqlx.Ext) error {
+		if _, err := tx.Exec(`INSERT INTO t (foo) VALUES (?)`, "uncommitted"); err != nil {
+			return err
+		}
+
+		// The single writer connection is busy with this
+		// transaction, so this would block without a read pool.
+		return db.WrapReadTx(func(rtx sqlx.Ext) error {
+			var count int
+			suite.Require().NoError(sqlx.Get(rtx, &count, `SELECT COUNT(*) FROM t`))
+			suite.Require().Equal(0, count)
+			return nil
+		})
+	}))
+
+	var count int
+	suite.Require().NoError(sqlx.Get(db.ReadHandle(), &count, `SELECT COUNT(*) FROM t`))
+	suite.Require().Equal(1, count)
+}
+
+func (suite *DBTestSuite) TestReaderDSN() {
+	dsn, err := readerDSN(OpenOptions{
+		File:       "test.db?mode=rwc&_pragma=foreign_keys(on)",
+		DSNOptions: url.Values{"mode": {"rw"}, "_pragma": {"journal_mode(wal)"}},
+	})
+	suite.Require().NoError(err)
+
+	path, query, _ := strings.Cut(dsn, "?")
+	suite.Require().Equal("test.db", path)
+	flags, err := url.ParseQuery(query)
+	suite.Require().NoError(err)
+	suite.Require().Equal([]string{"ro"}, flags["mode"])
+	suite.Require().Equal([]string{"foreign_keys(on)"}, flags["_pragma"])
+}
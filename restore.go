@@ -0,0 +1,219 @@
+package localdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// RestoreError is returned by Open when an upgrade failed and
+// OpenOptions.RestoreOnFailure caused the backup to be restored.
+// It wraps both the upgrade failure and any restore failure.
+type RestoreError struct {
+	// Err is the error that caused the upgrade to fail.
+	Err error
+
+	// Backup is the backup file that was restored.
+	Backup string
+
+	// RestoreErr is nil if the backup was restored successfully.
+	RestoreErr error
+}
+
+func (e *RestoreError) Error() string {
+	if e.RestoreErr != nil {
+		return fmt.Sprintf("%v (unable to restore backup %s: %v)", e.Err, e.Backup, e.RestoreErr)
+	}
+	return fmt.Sprintf("%v (restored backup %s)", e.Err, e.Backup)
+}
+
+func (e *RestoreError) Unwrap() []error {
+	if e.RestoreErr != nil {
+		return []error{e.Err, e.RestoreErr}
+	}
+	return []error{e.Err}
+}
+
+// sidecarSuffixes are the files SQLite keeps alongside a database.
+var sidecarSuffixes = []string{"-wal", "-shm", "-journal"}
+
+// Restore replaces options.File with backupFile, then opens it with
+// Open, upgrading it to the Schema's latest version.
+//
+// backupFile is decoded with options.BackupTransforms, and must be
+// a backup of a database belonging to options.Schema. Before
+// options.File is touched, the decoded backup is checked with
+// PRAGMA integrity_check (and foreign_key_check, if
+// options.VerifyBackup is set), its application_id must match the
+// Schema, and its user_version must not be newer than the Schema's
+// LatestVersion; otherwise Restore returns an error wrapping
+// ErrBackupInvalid. Any -wal, -shm or -journal files
+// belonging to options.File are removed, and the backup is renamed
+// over it atomically.
+//
+// options.File must not be open.
+func Restore(backupFile string, options OpenOptions) (*DB, error) {
+	return RestoreContext(context.Background(), backupFile, options)
+}
+
+// RestoreContext is like Restore, but uses ctx for all database
+// activity, including the upgrade.
+func RestoreContext(ctx context.Context, backupFile string, options OpenOptions) (*DB, error) {
+	if options.DriverName == "" {
+		return nil, errors.New("OpenOptions.DriverName is required")
+	}
+
+	in, err := os.Open(backupFile)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	dst, _, _ := strings.Cut(options.File, "?")
+	tmp, err := stageFile(dst, func(w io.Writer) error {
+		r, err := decodeBackup(in, options.BackupTransforms)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		_, err = io.Copy(w, r)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to restore backup %s: %w", backupFile, err)
+	}
+
+	if err = checkRestore(ctx, backupFile, tmp, options); err == nil {
+		err = installFile(tmp, dst)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+
+	return OpenContext(ctx, options)
+}
+
+// checkRestore checks that the decoded backup at path can be
+// restored and upgraded with options.Schema.
+func checkRestore(ctx context.Context, backupFile, path string, options OpenOptions) error {
+	schema := options.Schema
+	appId, userVersion, err := inspectBackup(ctx, options, versionStorer(options), backupFile, path, options.VerifyBackup)
+	if err != nil {
+		return err
+	}
+	if appId != schema.ApplicationID() {
+		return invalidBackup(backupFile, "application_id (%d) does not match schema ID (%d)", appId, schema.ApplicationID())
+	}
+	if userVersion > schema.LatestVersion() {
+		return invalidBackup(backupFile, "user_version (%d) is higher than the schema version (%d)", userVersion, schema.LatestVersion())
+	}
+	return nil
+}
+
+// RestoreBackup atomically replaces the database file dest with
+// the contents of backupFile, reversing the same transforms that
+// were given to OpenOptions.BackupTransforms when it was written.
+// Any -wal, -shm or -journal files belonging to dest are removed.
+//
+// dest must not be open. RestoreBackup does not check that the
+// backup is a valid database; see Restore.
+func RestoreBackup(backupFile, dest string, transforms []BackupTransform) error {
+	return replaceDatabaseFile(backupFile, dest, transforms)
+}
+
+// replaceDatabaseFile atomically replaces the database at dsn with
+// a decoded copy of src. The database must not be open.
+func replaceDatabaseFile(src, dsn string, transforms []BackupTransform) error {
+	dst, _, _ := strings.Cut(dsn, "?")
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	return replaceFile(dst, func(w io.Writer) error {
+		r, err := decodeBackup(in, transforms)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		_, err = io.Copy(w, r)
+		return err
+	})
+}
+
+// replaceFile writes a temporary file next to dst using write,
+// removes dst's SQLite sidecars, then renames the temporary file
+// over dst.
+func replaceFile(dst string, write func(io.Writer) error) error {
+	tmp, err := stageFile(dst, write)
+	if err != nil {
+		return err
+	}
+	if err = installFile(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// stageFile writes a temporary file next to dst using write,
+// returning its name.
+func stageFile(dst string, write func(io.Writer) error) (name string, err error) {
+	tmp, err := os.CreateTemp(filepath.Dir(dst), filepath.Base(dst)+".tmp-*")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if err = write(tmp); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err = tmp.Close(); err != nil {
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// installFile removes dst's SQLite sidecars, then renames tmp
+// over dst.
+func installFile(tmp, dst string) error {
+	// A stale WAL or hot journal would be applied to the new file
+	// the next time it is opened, so they must go first.
+	for _, suffix := range sidecarSuffixes {
+		if err := os.Remove(dst + suffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	if err := os.Rename(tmp, dst); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(dst))
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	// Not all platforms support syncing a directory
+	d.Sync()
+	return nil
+}
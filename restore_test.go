@@ -0,0 +1,151 @@
+package localdb
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func (suite *DBTestSuite) TestRestoreOnFailure() {
+	dir := filepath.Dir(suite.DBFile)
+	schema := NewSqlSchema(`CREATE TABLE t ( foo TEXT )`)
+	options := OpenOptions{
+		File:             suite.DBFile,
+		Schema:           schema,
+		DriverName:       "sqlite",
+		BackupDir:        filepath.Join(dir, "backups"),
+		RestoreOnFailure: true,
+	}
+
+	db, err := Open(options)
+	suite.Require().NoError(err)
+	_, err = db.Handle().Exec(`INSERT INTO t (foo) VALUES (?)`, "original")
+	suite.Require().NoError(err)
+	suite.Require().NoError(db.Close())
+
+	before, err := os.Stat(options.File)
+	suite.Require().NoError(err)
+	suite.Require().NoError(os.WriteFile(options.File+"-journal", []byte("stale"), 0644))
+
+	errHook := errors.New("hook failed")
+	schema.DefineUpgrade(2, `ALTER TABLE t ADD COLUMN bar TEXT;`)
+	schema.DefinePostUpgrade(2, func(tx sqlx.Ext) error {
+		return errHook
+	})
+
+	_, err = Open(options)
+	var restoreErr *RestoreError
+	suite.Require().ErrorAs(err, &restoreErr)
+	suite.Require().ErrorIs(err, errHook)
+	suite.Require().NoError(restoreErr.RestoreErr)
+	suite.Require().Equal(filepath.Join(options.BackupDir, "test.before_v2_upgrade.db"), restoreErr.Backup)
+
+	after, err := os.Stat(options.File)
+	suite.Require().NoError(err)
+	suite.Require().False(os.SameFile(before, after), "database file should have been replaced")
+	suite.Require().NoFileExists(options.File + "-journal")
+
+	sq := openRaw(suite.T(), options.File)
+	var foo string
+	suite.Require().NoError(sqlx.Get(sq, &foo, `SELECT foo FROM t`))
+	suite.Require().Equal("original", foo)
+	userVersion, err := (&SqliteVersion{}).GetUserVersion(sq)
+	suite.Require().NoError(err)
+	suite.Require().Equal(int32(1), userVersion)
+}
+
+func (suite *DBTestSuite) TestRestore() {
+	dir := filepath.Dir(suite.DBFile)
+	schema := NewSqlSchema(`CREATE TABLE t ( foo TEXT )`)
+	options := OpenOptions{
+		File:             suite.DBFile,
+		Schema:           schema,
+		DriverName:       "sqlite",
+		BackupTransforms: []BackupTransform{GzipTransform{}},
+	}
+
+	db, err := Open(options)
+	suite.Require().NoError(err)
+	_, err = db.Handle().Exec(`INSERT INTO t (foo) VALUES (?)`, "original")
+	suite.Require().NoError(err)
+	snapshot := filepath.Join(dir, "snapshot.db.gz")
+	_, err = db.Backup(context.Background(), snapshot)
+	suite.Require().NoError(err)
+	_, err = db.Handle().Exec(`INSERT INTO t (foo) VALUES (?)`, "later")
+	suite.Require().NoError(err)
+	suite.Require().NoError(db.Close())
+
+	foos := func() []string {
+		var foos []string
+		suite.Require().NoError(sqlx.Select(openRaw(suite.T(), options.File), &foos, `SELECT foo FROM t ORDER BY rowid`))
+		return foos
+	}
+
+	other := options
+	other.Schema = NewSqlSchema(`CREATE TABLE other ( foo TEXT )`)
+	_, err = Restore(snapshot, other)
+	suite.Require().ErrorIs(err, ErrBackupInvalid)
+	suite.Require().Equal([]string{"original", "later"}, foos(), "rejected restore should leave File in place")
+
+	plain := options
+	plain.BackupTransforms = nil
+	_, err = Restore(snapshot, plain)
+	suite.Require().ErrorIs(err, ErrBackupInvalid)
+
+	suite.Require().NoError(os.WriteFile(options.File+"-journal", []byte("stale"), 0644))
+
+	schema.DefineUpgrade(2, `ALTER TABLE t ADD COLUMN bar TEXT;`)
+	db, err = Restore(snapshot, options)
+	suite.Require().NoError(err)
+	suite.Require().NoFileExists(options.File + "-journal")
+
+	userVersion, err := (&SqliteVersion{}).GetUserVersion(db.Handle())
+	suite.Require().NoError(err)
+	suite.Require().Equal(int32(2), userVersion, "restored database should be upgraded")
+	newer := filepath.Join(dir, "newer.db.gz")
+	_, err = db.Backup(context.Background(), newer)
+	suite.Require().NoError(err)
+	suite.Require().NoError(db.Close())
+	suite.Require().Equal([]string{"original"}, foos())
+
+	older := options
+	older.Schema = NewSqlSchema(`CREATE TABLE t ( foo TEXT )`)
+	_, err = Restore(newer, older)
+	suite.Require().ErrorIs(err, ErrBackupInvalid)
+	suite.Require().ErrorContains(err, "higher than the schema version")
+
+	// foreign_keys is off by default, so a working database can
+	// have violations; only VerifyBackup rejects them
+	fk := OpenOptions{
+		File: filepath.Join(dir, "fk.db"),
+		Schema: NewSqlSchema(`
+CREATE TABLE parent ( id INTEGER PRIMARY KEY );
+CREATE TABLE child ( parent_id INTEGER REFERENCES parent (id) );`),
+		DriverName: "sqlite",
+	}
+	db, err = Open(fk)
+	suite.Require().NoError(err)
+	_, err = db.Handle().Exec(`INSERT INTO child (parent_id) VALUES (1)`)
+	suite.Require().NoError(err)
+	orphaned := filepath.Join(dir, "orphaned.db")
+	_, err = db.Backup(context.Background(), orphaned)
+	suite.Require().NoError(err)
+	suite.Require().NoError(db.Close())
+
+	fk.VerifyBackup = true
+	_, err = Restore(orphaned, fk)
+	suite.Require().ErrorIs(err, ErrBackupInvalid)
+	suite.Require().ErrorContains(err, "foreign_key_check")
+
+	fk.VerifyBackup = false
+	db, err = Restore(orphaned, fk)
+	suite.Require().NoError(err)
+	suite.Require().NoError(db.Close())
+
+	matches, err := filepath.Glob(filepath.Join(dir, "*.tmp-*"))
+	suite.Require().NoError(err)
+	suite.Require().Empty(matches, "temporary files should be cleaned up")
+}
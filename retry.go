@@ -0,0 +1,136 @@
+package localdb
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"strings"
+	"time"
+)
+
+// Primary result codes shared by every SQLite driver.
+// See https://www.sqlite.org/rescode.html
+const (
+	sqliteBusy   = 5
+	sqliteLocked = 6
+)
+
+// RetryPolicy controls automatic retries of WrapTx when the
+// transaction fails because the database is busy or locked.
+//
+// Each retry discards the failed transaction and invokes fn
+// again on a fresh transaction, so fn must not have side
+// effects outside of the transaction it is given.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the
+	// first. Values <= 1 disable retries.
+	MaxAttempts int
+
+	// InitialBackoff is the delay before the first retry.
+	// Defaults to 10ms.
+	InitialBackoff time.Duration
+
+	// MaxBackoff caps the delay between attempts. Defaults to 1s.
+	MaxBackoff time.Duration
+
+	// Multiplier is applied to the delay after each attempt.
+	// Defaults to 2.
+	Multiplier float64
+
+	// Retryable reports whether an error should trigger a retry.
+	// Defaults to IsBusy.
+	Retryable func(error) bool
+}
+
+// backoff returns the delay before the given retry (1-based),
+// randomized to between half and all of the exponential delay
+// so that competing writers do not retry in lockstep.
+func (p *RetryPolicy) backoff(retry int) time.Duration {
+	delay := p.InitialBackoff
+	if delay <= 0 {
+		delay = 10 * time.Millisecond
+	}
+	limit := p.MaxBackoff
+	if limit <= 0 {
+		limit = time.Second
+	}
+	mult := p.Multiplier
+	if mult < 1 {
+		mult = 2
+	}
+
+	for i := 1; i < retry && delay < limit; i++ {
+		delay = time.Duration(float64(delay) * mult)
+	}
+	delay = min(delay, limit)
+
+	half := delay / 2
+	return half + rand.N(delay-half+1)
+}
+
+func (p *RetryPolicy) retryable(err error) bool {
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return IsBusy(err)
+}
+
+// withRetry invokes attempt until it succeeds, returns a
+// non-retryable error, or the policy's attempts are exhausted.
+// A nil policy invokes attempt exactly once.
+func (p *RetryPolicy) withRetry(ctx context.Context, attempt func() error) error {
+	err := attempt()
+	if p == nil {
+		return err
+	}
+
+	for retry := 1; retry < p.MaxAttempts && err != nil && p.retryable(err); retry++ {
+		timer := time.NewTimer(p.backoff(retry))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return errors.Join(err, ctx.Err())
+		case <-timer.C:
+		}
+
+		err = attempt()
+	}
+	return err
+}
+
+// IsBusy reports whether err indicates that SQLite could not
+// proceed because the database or a table was locked by another
+// connection (SQLITE_BUSY or SQLITE_LOCKED).
+//
+// IsBusy is driver-neutral. Errors exposing a Code() int method
+// (such as modernc.org/sqlite) are classified by their primary
+// result code; other errors (such as github.com/mattn/go-sqlite3)
+// are classified by SQLite's standard error messages.
+func IsBusy(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var coder interface{ Code() int }
+	if errors.As(err, &coder) {
+		switch coder.Code() & 0xff {
+		case sqliteBusy, sqliteLocked:
+			return true
+		}
+		return false
+	}
+
+	msg := err.Error()
+	for _, s := range []string{
+		"database is locked",
+		"database table is locked",
+		"database schema is locked",
+		"SQLITE_BUSY",
+		"SQLITE_LOCKED",
+	} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,88 @@
+package localdb
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type codeError int
+
+func (c codeError) Error() string { return fmt.Sprintf("sqlite error %d", int(c)) }
+func (c codeError) Code() int     { return int(c) }
+
+func (suite *DBTestSuite) TestIsBusy() {
+	suite.Require().False(IsBusy(nil))
+	suite.Require().True(IsBusy(codeError(sqliteBusy)))
+	suite.Require().True(IsBusy(fmt.Errorf("wrapped: %w", codeError(sqliteLocked))))
+	// SQLITE_BUSY_SNAPSHOT is an extended code of SQLITE_BUSY
+	suite.Require().True(IsBusy(codeError(sqliteBusy | (2 << 8))))
+	suite.Require().False(IsBusy(codeError(19)))
+	suite.Require().True(IsBusy(errors.New("database is locked")))
+	suite.Require().True(IsBusy(errors.New("database table is locked")))
+	suite.Require().False(IsBusy(errors.New("no such table: t")))
+}
+
+func (suite *DBTestSuite) TestRetryBackoff() {
+	p := &RetryPolicy{InitialBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+	for retry, upper := range []time.Duration{10, 20, 40, 50, 50} {
+		upper *= time.Millisecond
+		d := p.backoff(retry + 1)
+		suite.Require().LessOrEqual(d, upper)
+		suite.Require().GreaterOrEqual(d, upper/2)
+	}
+}
+
+func (suite *DBTestSuite) TestWrapTxRetry() {
+	schema := NewSqlSchema(`CREATE TABLE t ( foo TEXT )`)
+
+	holder, err := Open(OpenOptions{File: suite.DBFile, Schema: schema, DriverName: "sqlite"})
+	suite.Require().NoError(err)
+	defer holder.Close()
+
+	plain, err := Open(OpenOptions{File: suite.DBFile, Schema: schema, DriverName: "sqlite"})
+	suite.Require().NoError(err)
+	defer plain.Close()
+
+	retrying, err := Open(OpenOptions{File: suite.DBFile, Schema: schema, DriverName: "sqlite", Retry: &RetryPolicy{
+		MaxAttempts:    50,
+		InitialBackoff: 5 * time.Millisecond,
+		MaxBackoff:     20 * time.Millisecond,
+	}})
+	suite.Require().NoError(err)
+	defer retrying.Close()
+
+	locked := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- holder.WrapTx(func(tx sqlx.Ext) error {
+			if _, err := tx.Exec(`INSERT INTO t (foo) VALUES (?)`, "holder"); err != nil {
+				return err
+			}
+			close(locked)
+			<-release
+			return nil
+		})
+	}()
+	<-locked
+
+	insert := func(tx sqlx.Ext) error {
+		_, err := tx.Exec(`INSERT INTO t (foo) VALUES (?)`, "writer")
+		return err
+	}
+
+	err = plain.WrapTx(insert)
+	suite.Require().Error(err)
+	suite.Require().True(IsBusy(err), "expected busy error, got %v", err)
+
+	time.AfterFunc(50*time.Millisecond, func() { close(release) })
+	suite.Require().NoError(retrying.WrapTx(insert))
+	suite.Require().NoError(<-done)
+
+	var count int
+	suite.Require().NoError(sqlx.Get(retrying.Handle(), &count, `SELECT COUNT(*) FROM t`))
+	suite.Require().Equal(2, count)
+}
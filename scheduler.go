@@ -0,0 +1,215 @@
+package localdb
+
+import (
+	"context"
+	"errors"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// BackupSchedule configures a BackupScheduler.
+type BackupSchedule struct {
+	// Interval between snapshots. Required.
+	Interval time.Duration
+
+	// Dir is the directory snapshots are written to. Defaults to
+	// the OpenOptions.BackupDir the DB was opened with.
+	//
+	// Snapshots are named "${BASENAME}.snapshot.${TIMESTAMP}.${EXT}",
+	// following the same conventions as upgrade backups.
+	Dir string
+
+	// Policy, if non-nil, applies retention after each snapshot.
+	// Only snapshots are considered; upgrade backups in the same
+	// directory are not affected. Policy.Timestamp and
+	// Policy.RotateExisting are ignored, as snapshot names are
+	// always timestamped.
+	Policy *BackupPolicy
+}
+
+// BackupStatus reports the outcome of a BackupScheduler's runs.
+type BackupStatus struct {
+	// LastSuccess is the time of the most recent snapshot.
+	LastSuccess time.Time
+
+	// LastSnapshot is the path of the most recent snapshot.
+	LastSnapshot string
+
+	// LastError is the error from the most recent run, or nil if
+	// it succeeded or was skipped. A run cancelled by Stop is not
+	// recorded.
+	LastError error
+
+	// Skipped counts runs that took no snapshot because the
+	// database had not changed since the previous snapshot.
+	Skipped int
+}
+
+// BackupScheduler takes periodic snapshots of a DB using
+// DB.Backup. Runs are skipped when the database has not changed
+// since the last snapshot, as detected by PRAGMA data_version
+// on a dedicated read-only connection.
+type BackupScheduler struct {
+	db       *DB
+	schedule BackupSchedule
+	pattern  *regexp.Regexp
+
+	monitor *sqlx.DB
+	conn    *sqlx.Conn
+
+	cancel context.CancelFunc
+	done   chan struct{}
+	once   sync.Once
+
+	// Only accessed by run
+	dataVersion int64
+	hasVersion  bool
+
+	mu     sync.Mutex
+	status BackupStatus
+}
+
+// NewBackupScheduler starts taking snapshots of db every
+// schedule.Interval. The first snapshot is taken after one
+// interval has elapsed. Call Stop before closing db.
+func NewBackupScheduler(db *DB, schedule BackupSchedule) (*BackupScheduler, error) {
+	if schedule.Interval <= 0 {
+		return nil, errors.New("BackupSchedule.Interval must be positive")
+	}
+	if schedule.Dir == "" {
+		schedule.Dir = db.options.BackupDir
+	}
+	if schedule.Dir == "" {
+		return nil, errors.New("BackupSchedule.Dir is required when the DB has no BackupDir")
+	}
+	if err := os.MkdirAll(schedule.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// data_version only reflects changes made by other connections,
+	// so the scheduler monitors the database on its own connection.
+	monitor, err := openReader(ctx, db.options, 1)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	conn, err := monitor.Connx(ctx)
+	if err != nil {
+		cancel()
+		monitor.Close()
+		return nil, err
+	}
+
+	base, ext := splitBackupBase(db.options)
+	s := &BackupScheduler{
+		db:       db,
+		schedule: schedule,
+		pattern: regexp.MustCompile(`^` + regexp.QuoteMeta(base) +
+			`\.snapshot\.\d{8}T\d{6}Z(-\d+)?` + regexp.QuoteMeta(ext) + `$`),
+		monitor: monitor,
+		conn:    conn,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+
+	go s.run(ctx)
+	return s, nil
+}
+
+func (s *BackupScheduler) run(ctx context.Context) {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.schedule.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.tick(ctx)
+		}
+	}
+}
+
+func (s *BackupScheduler) tick(ctx context.Context) {
+	var dataVersion int64
+	err := s.conn.QueryRowxContext(ctx, `PRAGMA data_version`).Scan(&dataVersion)
+	if err != nil {
+		s.finish(ctx, "", err)
+		return
+	}
+
+	if s.hasVersion && dataVersion == s.dataVersion {
+		s.mu.Lock()
+		s.status.Skipped++
+		s.status.LastError = nil
+		s.mu.Unlock()
+		return
+	}
+
+	base, ext := splitBackupBase(s.db.options)
+	dest := uniqueBackupName(s.schedule.Dir, base+".snapshot", ext, time.Now())
+	if _, err = s.db.Backup(ctx, dest); err != nil {
+		s.finish(ctx, "", err)
+		return
+	}
+
+	s.dataVersion = dataVersion
+	s.hasVersion = true
+
+	if s.schedule.Policy != nil {
+		backups, err := listBackupFiles(s.schedule.Dir, s.pattern)
+		if err == nil {
+			err = pruneBackupFiles(s.schedule.Policy, backups, dest)
+		}
+		if err != nil {
+			s.finish(ctx, dest, err)
+			return
+		}
+	}
+
+	s.finish(ctx, dest, nil)
+}
+
+// finish records the outcome of a run. dest is non-empty if a
+// snapshot was written, even if retention then failed.
+func (s *BackupScheduler) finish(ctx context.Context, dest string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if dest != "" {
+		s.status.LastSuccess = time.Now()
+		s.status.LastSnapshot = dest
+	}
+	// A run cancelled by Stop did not fail, so keep the
+	// previous run's outcome
+	if err == nil || ctx.Err() == nil {
+		s.status.LastError = err
+	}
+}
+
+// Status returns the outcome of the scheduler's runs so far.
+func (s *BackupScheduler) Status() BackupStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status
+}
+
+// Stop cancels any snapshot in progress, stops the scheduler,
+// and waits for it to exit. It is safe to call Stop more than once.
+func (s *BackupScheduler) Stop() error {
+	var err error
+	s.once.Do(func() {
+		s.cancel()
+		<-s.done
+		err = errors.Join(s.conn.Close(), s.monitor.Close())
+	})
+	return err
+}
@@ -0,0 +1,98 @@
+package localdb
+
+import (
+	"context"
+	"path/filepath"
+	"time"
+)
+
+func (suite *DBTestSuite) TestBackupScheduler() {
+	dir := filepath.Dir(suite.DBFile)
+	db, err := Open(OpenOptions{
+		File:       suite.DBFile,
+		Schema:     NewSqlSchema(`CREATE TABLE t ( foo TEXT )`),
+		DriverName: "sqlite",
+		BackupDir:  filepath.Join(dir, "backups"),
+	})
+	suite.Require().NoError(err)
+	defer db.Close()
+
+	_, err = NewBackupScheduler(db, BackupSchedule{})
+	suite.Require().Error(err)
+
+	scheduler, err := NewBackupScheduler(db, BackupSchedule{
+		Interval: 10 * time.Millisecond,
+		Policy:   &BackupPolicy{KeepLast: 2},
+	})
+	suite.Require().NoError(err)
+	defer scheduler.Stop()
+
+	snapshots := func() []string {
+		backups, err := listBackupFiles(filepath.Join(dir, "backups"), scheduler.pattern)
+		suite.Require().NoError(err)
+		names := make([]string, len(backups))
+		for i, b := range backups {
+			names[i] = filepath.Base(b.path)
+		}
+		return names
+	}
+
+	suite.Require().Eventually(func() bool {
+		return !scheduler.Status().LastSuccess.IsZero()
+	}, 5*time.Second, 5*time.Millisecond)
+	status := scheduler.Status()
+	suite.Require().NoError(status.LastError)
+	suite.Require().Regexp(`^test\.snapshot\.\d{8}T\d{6}Z(-\d+)?\.db$`, filepath.Base(status.LastSnapshot))
+
+	// Unchanged databases are not snapshotted again
+	skipped := status.Skipped
+	suite.Require().Eventually(func() bool {
+		return scheduler.Status().Skipped >= skipped+3
+	}, 5*time.Second, 5*time.Millisecond)
+	suite.Require().Equal(status.LastSnapshot, scheduler.Status().LastSnapshot)
+	suite.Require().Len(snapshots(), 1)
+
+	for i := 0; i < 3; i++ {
+		last := scheduler.Status().LastSnapshot
+		_, err = db.Handle().Exec(`INSERT INTO t (foo) VALUES (?)`, "change")
+		suite.Require().NoError(err)
+		suite.Require().Eventually(func() bool {
+			return scheduler.Status().LastSnapshot != last
+		}, 5*time.Second, 5*time.Millisecond)
+	}
+
+	suite.Require().NoError(scheduler.Stop())
+	suite.Require().NoError(scheduler.Stop())
+	suite.Require().NoError(scheduler.Status().LastError)
+	suite.Require().Len(snapshots(), 2, "retention should keep the two newest snapshots")
+	suite.Require().Contains(snapshots(), filepath.Base(scheduler.Status().LastSnapshot))
+}
+
+func (suite *DBTestSuite) TestBackupSchedulerCancelled() {
+	db, err := Open(OpenOptions{
+		File:       suite.DBFile,
+		Schema:     NewSqlSchema(`CREATE TABLE t ( foo TEXT )`),
+		DriverName: "sqlite",
+		BackupDir:  filepath.Join(filepath.Dir(suite.DBFile), "backups"),
+	})
+	suite.Require().NoError(err)
+	defer db.Close()
+
+	// Runs are driven by hand, so the ticker must not fire
+	scheduler, err := NewBackupScheduler(db, BackupSchedule{Interval: time.Hour})
+	suite.Require().NoError(err)
+	defer scheduler.Stop()
+
+	scheduler.tick(context.Background())
+	status := scheduler.Status()
+	suite.Require().NoError(status.LastError)
+	suite.Require().NotEmpty(status.LastSnapshot)
+
+	// A run cancelled by Stop is not a failure
+	_, err = db.Handle().Exec(`INSERT INTO t (foo) VALUES (?)`, "change")
+	suite.Require().NoError(err)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	scheduler.tick(ctx)
+	suite.Require().Equal(status, scheduler.Status())
+}
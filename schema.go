@@ -1,17 +1,26 @@
 package localdb
 
 import (
+	"context"
 	"fmt"
 	"hash/crc32"
-	"os"
-	"path/filepath"
-	"strings"
+	"maps"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 )
 
 var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
 
+// SchemaLegacyHelper inspects a database that has no application_id,
+// such as one created before the application adopted localdb, and
+// reports which version of the schema it corresponds to. See
+// SqlSchema.DefineLegacy.
+//
+// A userVersion of 0 means the database is not a legacy database
+// (for example, because it is empty), and it is initialized
+// normally. Otherwise, applicationId must be the schema's
+// ApplicationID.
 type SchemaLegacyHelper func(q sqlx.Queryer) (applicationId int32, userVersion int32, err error)
 
 type Schema interface {
@@ -37,13 +46,56 @@ type Schema interface {
 	Upgrade(tx sqlx.Ext, currentVersion int32) (updatedVersion int32, err error)
 }
 
+// Downgrader is an optional interface for a Schema that can
+// roll a database back to an older version. It is only used
+// when OpenOptions.AllowDowngrade is set.
+type Downgrader interface {
+	// Downgrade the database from currentVersion to
+	// targetVersion, which must be lower than currentVersion.
+	Downgrade(tx sqlx.Ext, currentVersion int32, targetVersion int32) error
+}
+
+// LegacyAdopter is an optional interface for a Schema that can
+// recognize databases created before the application used localdb.
+// Open consults it whenever the database's application_id is 0.
+type LegacyAdopter interface {
+	// AdoptLegacy has the same semantics as SchemaLegacyHelper.
+	AdoptLegacy(q sqlx.Queryer) (applicationId int32, userVersion int32, err error)
+}
+
+// VersionStorerProvider is an optional interface for a Schema that
+// supplies the VersionStorer used to open its databases, so that a
+// schema can ship its versioning strategy along with its migrations.
+// OpenOptions.VersionStorer takes precedence when set.
+type VersionStorerProvider interface {
+	// DefaultVersionStorer returns the schema's VersionStorer,
+	// or nil to use SqliteVersion.
+	DefaultVersionStorer() VersionStorer
+}
+
+// StepUpgrader is an optional interface for a Schema that can
+// upgrade a database one version at a time. It is required by
+// OpenOptions.StepwiseUpgrade.
+type StepUpgrader interface {
+	// UpgradeStep upgrades the database from version-1 to version.
+	// It must not update the version stored by the VersionStorer.
+	UpgradeStep(tx sqlx.Ext, version int32) error
+}
+
 // UpgradeHook is a callback invoked before or after a schema upgrade step.
 // It receives the transaction handle and can return an error to abort the upgrade.
 type UpgradeHook func(tx sqlx.Ext) error
 
+// UpgradeFunc is a schema upgrade step implemented in Go. See
+// SqlSchema.DefineUpgradeFunc.
+type UpgradeFunc func(tx Handle) error
+
 type versionHooks struct {
 	pre  UpgradeHook
 	post UpgradeHook
+
+	preDowngrade  UpgradeHook
+	postDowngrade UpgradeHook
 }
 
 type SqlSchema struct {
@@ -54,12 +106,23 @@ type SqlSchema struct {
 
 	// VersionStorer is set to SqliteVersion by default.
 	// May be overridden prior to use to assist with
-	// migrating existing databases.
+	// migrating existing databases. It is used by Open
+	// unless OpenOptions.VersionStorer is set.
 	VersionStorer VersionStorer
 
-	versions []string
-	hooks    map[int]versionHooks
-	legacy   SchemaLegacyHelper
+	// RecordHistory enables the localdb_migrations table, which
+	// records the checksum, time, and duration of each version as
+	// it is applied. When enabled, Open verifies the checksums of
+	// previously applied versions and returns a
+	// *ChecksumMismatchError if their SQL has since been edited.
+	RecordHistory bool
+
+	versions   []string
+	funcs      map[int]UpgradeFunc
+	noTx       map[int]bool
+	downgrades map[int]string
+	hooks      map[int]versionHooks
+	legacy     SchemaLegacyHelper
 }
 
 func (s *SqlSchema) ApplicationID() int32 {
@@ -72,6 +135,9 @@ func NewSqlSchema(rootSchema string) *SqlSchema {
 		ID:            int32(crc32.Checksum([]byte(rootSchema), crc32cTable)),
 		VersionStorer: &SqliteVersion{},
 		versions:      []string{rootSchema},
+		funcs:         make(map[int]UpgradeFunc),
+		noTx:          make(map[int]bool),
+		downgrades:    make(map[int]string),
 		hooks:         make(map[int]versionHooks),
 	}
 }
@@ -89,8 +155,69 @@ func (s *SqlSchema) DefineUpgrade(newVersion int, newSchema string) {
 	s.versions = append(s.versions, newSchema)
 }
 
+// DefineUpgradeFunc registers a new version of the schema that is
+// implemented by fn instead of SQL, for data migrations that are
+// easier to express in Go. fn runs within the upgrade transaction,
+// between any pre- and post-upgrade hooks for the version, and
+// may use tx to prepare statements.
+//
+// fn has no SQL to checksum, so when RecordHistory is enabled,
+// changes to fn are not detected.
+// Panics under the same conditions as DefineUpgrade, or if fn is nil.
+func (s *SqlSchema) DefineUpgradeFunc(newVersion int, fn UpgradeFunc) {
+	if fn == nil {
+		panic("nil DefineUpgradeFunc func")
+	}
+	s.DefineUpgrade(newVersion, "")
+	s.funcs[newVersion] = fn
+}
+
+// DefineUpgradeNoTx is like DefineUpgrade, but when Open applies
+// the new version, its SQL and hooks run outside of the upgrade
+// transaction. This is required for statements that SQLite does
+// not allow within a transaction, such as VACUUM or
+// PRAGMA journal_mode=WAL.
+//
+// Open commits the versions before newVersion first, then runs
+// newVersion on its own connection and immediately records it as
+// the database's version. If Open is interrupted before the
+// version is recorded, newVersion runs again on the next Open,
+// so its SQL and hooks should be idempotent.
+func (s *SqlSchema) DefineUpgradeNoTx(newVersion int, newSchema string) {
+	s.DefineUpgrade(newVersion, newSchema)
+	s.noTx[newVersion] = true
+}
+
+// DefineLegacy registers a helper that identifies legacy databases
+// which have tables but no application_id. When the helper maps
+// such a database to a version, Open records the schema's
+// ApplicationID and upgrades the database from that version,
+// instead of running the root schema on top of its existing
+// tables. If the database is already at the latest version, only
+// the application_id and version are stored (see PlanAdopt).
+//
+// The helper is called whenever Open finds an application_id of 0,
+// including for new, empty databases, so it must return a
+// userVersion of 0 when it does not recognize the database.
+// Panics if a legacy helper is already defined.
+func (s *SqlSchema) DefineLegacy(helper SchemaLegacyHelper) {
+	if s.legacy != nil {
+		panic("legacy helper already defined")
+	}
+	s.legacy = helper
+}
+
+// AdoptLegacy implements LegacyAdopter.
+func (s *SqlSchema) AdoptLegacy(q sqlx.Queryer) (applicationId int32, userVersion int32, err error) {
+	if s.legacy == nil {
+		return 0, 0, nil
+	}
+	return s.legacy(q)
+}
+
 // DefinePreUpgrade registers a callback to run before the SQL for the given
-// version. The callback runs within the same transaction as the upgrade.
+// version. The callback runs within the same transaction as the upgrade,
+// unless the version was defined with DefineUpgradeNoTx.
 // Panics if the version is out of range or a pre-upgrade hook is already defined.
 func (s *SqlSchema) DefinePreUpgrade(version int, fn UpgradeHook) {
 	if version < 1 || version > len(s.versions) {
@@ -105,7 +232,8 @@ func (s *SqlSchema) DefinePreUpgrade(version int, fn UpgradeHook) {
 }
 
 // DefinePostUpgrade registers a callback to run after the SQL for the given
-// version. The callback runs within the same transaction as the upgrade.
+// version. The callback runs within the same transaction as the upgrade,
+// unless the version was defined with DefineUpgradeNoTx.
 // Panics if the version is out of range or a post-upgrade hook is already defined.
 func (s *SqlSchema) DefinePostUpgrade(version int, fn UpgradeHook) {
 	if version < 1 || version > len(s.versions) {
@@ -119,58 +247,217 @@ func (s *SqlSchema) DefinePostUpgrade(version int, fn UpgradeHook) {
 	s.hooks[version] = h
 }
 
-func backupFilename(options OpenOptions, schema Schema) string {
-	base := filepath.Base(options.File)
-	ext := filepath.Ext(base)
-	base = strings.TrimSuffix(base, ext)
-	return filepath.Join(options.BackupDir, fmt.Sprintf("%s.before_v%d_upgrade%s", base, schema.LatestVersion(), ext))
+// DefineDowngrade registers the SQL that reverts the given version
+// to version-1. DefineDowngrade only affects subsequent Open calls
+// with OpenOptions.AllowDowngrade set.
+//
+// Unlike DefineUpgrade, version may be higher than LatestVersion,
+// so that a patch release of an older binary can ship the scripts
+// needed to roll back a database written by a newer one.
+// Panics if version is less than 2 or a downgrade is already defined.
+func (s *SqlSchema) DefineDowngrade(version int, sql string) {
+	if version < 2 {
+		panic("DefineDowngrade version out of range")
+	}
+	if _, ok := s.downgrades[version]; ok {
+		panic("downgrade already defined")
+	}
+	s.downgrades[version] = sql
 }
 
-func initDB(db *DB, options OpenOptions, vs VersionStorer) error {
-	schema := options.Schema
-
-	applicationId, err := vs.GetApplicationId(db.Handle())
-	if err != nil {
-		return err
+// DefinePreDowngrade registers a callback to run before the downgrade
+// SQL for the given version. The callback runs within the same
+// transaction as the downgrade.
+// Panics if version is less than 2 or a pre-downgrade hook is already defined.
+func (s *SqlSchema) DefinePreDowngrade(version int, fn UpgradeHook) {
+	if version < 2 {
+		panic("DefinePreDowngrade version out of range")
 	}
+	h := s.hooks[version]
+	if h.preDowngrade != nil {
+		panic("pre-downgrade hook already defined")
+	}
+	h.preDowngrade = fn
+	s.hooks[version] = h
+}
 
-	if applicationId != 0 && applicationId != schema.ApplicationID() {
-		return fmt.Errorf("application_id (%d) does not match schema ID (%d)", applicationId, schema.ApplicationID())
+// DefinePostDowngrade registers a callback to run after the downgrade
+// SQL for the given version. The callback runs within the same
+// transaction as the downgrade.
+// Panics if version is less than 2 or a post-downgrade hook is already defined.
+func (s *SqlSchema) DefinePostDowngrade(version int, fn UpgradeHook) {
+	if version < 2 {
+		panic("DefinePostDowngrade version out of range")
 	}
+	h := s.hooks[version]
+	if h.postDowngrade != nil {
+		panic("post-downgrade hook already defined")
+	}
+	h.postDowngrade = fn
+	s.hooks[version] = h
+}
 
-	userVersion, err := vs.GetUserVersion(db.Handle())
+// initDB brings the database to the schema's latest version.
+// If a backup was taken before the database was changed,
+// its path is returned, even if the change then failed.
+func initDB(ctx context.Context, db *DB, options OpenOptions, vs VersionStorer) (backup string, err error) {
+	schema := options.Schema
+	h := db.handleContext(ctx)
+
+	p, err := planDB(h, options, vs)
 	if err != nil {
-		return err
+		return "", err
+	}
+	if p.Err != nil {
+		return "", p.Err
+	}
+	if p.Action == PlanNone && len(p.Modules) == 0 {
+		return "", nil
 	}
 
-	if userVersion > schema.LatestVersion() {
-		return fmt.Errorf("user_version (%d) is higher than the schema version (%d)", userVersion, schema.LatestVersion())
+	if p.Backup != "" {
+		if err = createBackup(ctx, h, options, vs, p); err != nil {
+			return "", err
+		}
 	}
 
-	if applicationId == schema.ApplicationID() && userVersion == schema.LatestVersion() {
-		return nil
+	// Modules are upgraded in the same transaction as the schema,
+	// so that a failing module rolls the schema back too
+	switch {
+	case p.Action == PlanNone:
+		err = db.WrapTxContext(ctx, func(tx sqlx.Ext) error {
+			return upgradeModules(tx, p.Modules)
+		})
+
+	case p.Action == PlanAdopt:
+		err = db.WrapTxContext(ctx, func(tx sqlx.Ext) error {
+			if err := vs.SetApplicationId(tx, schema.ApplicationID()); err != nil {
+				return err
+			}
+			if err := vs.SetUserVersion(tx, p.CurrentVersion); err != nil {
+				return err
+			}
+			return upgradeModules(tx, p.Modules)
+		})
+
+	case p.Action == PlanDowngrade:
+		err = db.WrapTxContext(ctx, func(tx sqlx.Ext) error {
+			if err := schema.(Downgrader).Downgrade(tx, p.CurrentVersion, p.TargetVersion); err != nil {
+				return err
+			}
+
+			// Legacy databases have no application_id yet
+			if err := vs.SetApplicationId(tx, schema.ApplicationID()); err != nil {
+				return err
+			}
+			if err := vs.SetUserVersion(tx, p.TargetVersion); err != nil {
+				return err
+			}
+			return upgradeModules(tx, p.Modules)
+		})
+
+	case options.StepwiseUpgrade || hasNoTxSteps(p.Steps):
+		err = upgradeSteps(ctx, db, options, vs, p)
+
+	default:
+		err = db.WrapTxContext(ctx, func(tx sqlx.Ext) error {
+			if err := vs.SetApplicationId(tx, schema.ApplicationID()); err != nil {
+				return err
+			}
+
+			newVersion, err := schema.Upgrade(tx, p.CurrentVersion)
+			if err != nil {
+				return err
+			}
+
+			if err = vs.SetUserVersion(tx, newVersion); err != nil {
+				return err
+			}
+			return upgradeModules(tx, p.Modules)
+		})
 	}
+	return p.Backup, err
+}
+
+// upgradeSteps applies the plan's steps in groups. Each NoTx step
+// runs outside of any transaction, and is followed immediately by
+// updating user_version. The remaining steps run in a transaction
+// per step if StepwiseUpgrade is set, or otherwise a transaction
+// per run of consecutive steps, which updates user_version before
+// it commits. Modules are upgraded in the last transaction, or in
+// a transaction of their own if the last step is NoTx.
+func upgradeSteps(ctx context.Context, db *DB, options OpenOptions, vs VersionStorer, p *UpgradePlan) error {
+	schema := options.Schema
+	stepper := schema.(StepUpgrader)
 
-	if options.BackupDir != "" && applicationId != 0 && userVersion != 0 {
-		os.MkdirAll(options.BackupDir, 0755)
-		backupFile := backupFilename(options, schema)
-		if _, err = db.Handle().Exec(`VACUUM INTO ?`, backupFile); err != nil {
-			return fmt.Errorf("unable to create backup %s: %w", backupFile, err)
+	for steps := p.Steps; len(steps) > 0; {
+		if steps[0].NoTx {
+			if err := upgradeNoTx(ctx, db, schema, vs, steps[0].Version); err != nil {
+				return err
+			}
+			steps = steps[1:]
+			if len(steps) == 0 && len(p.Modules) != 0 {
+				return db.WrapTxContext(ctx, func(tx sqlx.Ext) error {
+					return upgradeModules(tx, p.Modules)
+				})
+			}
+			continue
 		}
-	}
 
-	return db.WrapTx(func(tx sqlx.Ext) error {
-		if err = vs.SetApplicationId(tx, schema.ApplicationID()); err != nil {
-			return err
+		n := 1
+		for !options.StepwiseUpgrade && n < len(steps) && !steps[n].NoTx {
+			n++
 		}
+		group := steps[:n]
+		steps = steps[n:]
+		last := len(steps) == 0
 
-		newVersion, err := schema.Upgrade(tx, userVersion)
+		err := db.WrapTxContext(ctx, func(tx sqlx.Ext) error {
+			if err := vs.SetApplicationId(tx, schema.ApplicationID()); err != nil {
+				return err
+			}
+			for _, step := range group {
+				if err := stepper.UpgradeStep(tx, step.Version); err != nil {
+					return err
+				}
+			}
+			if err := vs.SetUserVersion(tx, group[len(group)-1].Version); err != nil {
+				return err
+			}
+			if last {
+				return upgradeModules(tx, p.Modules)
+			}
+			return nil
+		})
 		if err != nil {
 			return err
 		}
+	}
+	return nil
+}
+
+// upgradeNoTx applies version on a dedicated connection, outside
+// of any transaction.
+func upgradeNoTx(ctx context.Context, db *DB, schema Schema, vs VersionStorer, version int32) error {
+	conn, err := db.root.Connx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	h := bindContext(ctx, db.root.DriverName(), conn)
+
+	if err = schema.(StepUpgrader).UpgradeStep(h, version); err != nil {
+		return err
+	}
+	if err = vs.SetApplicationId(h, schema.ApplicationID()); err != nil {
+		return err
+	}
+	return vs.SetUserVersion(h, version)
+}
 
-		return vs.SetUserVersion(tx, newVersion)
-	})
+// DefaultVersionStorer implements VersionStorerProvider.
+func (s *SqlSchema) DefaultVersionStorer() VersionStorer {
+	return s.VersionStorer
 }
 
 func (s *SqlSchema) LatestVersion() int32 {
@@ -180,24 +467,142 @@ func (s *SqlSchema) LatestVersion() int32 {
 func (s *SqlSchema) Upgrade(tx sqlx.Ext, currentVersion int32) (newVersion int32, err error) {
 	newVersion = s.LatestVersion()
 
+	if s.RecordHistory && currentVersion < newVersion {
+		if err := createMigrationsTable(tx); err != nil {
+			return -1, fmt.Errorf("unable to create %s: %w", migrationsTable, err)
+		}
+	}
+
 	for i := currentVersion; i < newVersion; i++ {
-		version := int(i) + 1
-		if h, ok := s.hooks[version]; ok && h.pre != nil {
-			if err := h.pre(tx); err != nil {
-				return -1, fmt.Errorf("error during v%d pre-upgrade hook: %w", version, err)
+		if err := s.upgradeStep(tx, int(i)+1); err != nil {
+			return -1, err
+		}
+	}
+
+	return newVersion, nil
+}
+
+// UpgradeStep implements StepUpgrader.
+func (s *SqlSchema) UpgradeStep(tx sqlx.Ext, version int32) error {
+	if version < 1 || version > s.LatestVersion() {
+		return fmt.Errorf("invalid upgrade step v%d", version)
+	}
+
+	if s.RecordHistory {
+		if err := createMigrationsTable(tx); err != nil {
+			return fmt.Errorf("unable to create %s: %w", migrationsTable, err)
+		}
+	}
+
+	return s.upgradeStep(tx, int(version))
+}
+
+func (s *SqlSchema) upgradeStep(tx sqlx.Ext, version int) error {
+	started := time.Now()
+	if h, ok := s.hooks[version]; ok && h.pre != nil {
+		if err := h.pre(tx); err != nil {
+			return fmt.Errorf("error during v%d pre-upgrade hook: %w", version, err)
+		}
+	}
+	if fn, ok := s.funcs[version]; ok {
+		h, ok := tx.(Handle)
+		if !ok {
+			return fmt.Errorf("error during v%d schema upgrade: %T does not implement Handle", version, tx)
+		}
+		if err := fn(h); err != nil {
+			return fmt.Errorf("error during v%d schema upgrade: %w", version, err)
+		}
+	} else if _, err := tx.Exec(s.versions[version-1]); err != nil {
+		return fmt.Errorf("error during v%d schema upgrade: %w", version, err)
+	}
+	if h, ok := s.hooks[version]; ok && h.post != nil {
+		if err := h.post(tx); err != nil {
+			return fmt.Errorf("error during v%d post-upgrade hook: %w", version, err)
+		}
+	}
+	if s.RecordHistory {
+		if err := recordMigration(tx, version, s.versions[version-1], started); err != nil {
+			return fmt.Errorf("unable to record v%d in %s: %w", version, migrationsTable, err)
+		}
+	}
+	return nil
+}
+
+// PlanSteps implements Planner.
+func (s *SqlSchema) PlanSteps(currentVersion int32, targetVersion int32) ([]PlanStep, error) {
+	var steps []PlanStep
+
+	for i := currentVersion; i < targetVersion; i++ {
+		h := s.hooks[int(i)+1]
+		steps = append(steps, PlanStep{
+			Version: i + 1,
+			SQL:     s.versions[i],
+			Hooks:   h.pre != nil || h.post != nil,
+			Func:    s.funcs[int(i)+1] != nil,
+			NoTx:    s.noTx[int(i)+1],
+		})
+	}
+
+	for i := currentVersion; i > targetVersion; i-- {
+		sql, ok := s.downgrades[int(i)]
+		if !ok {
+			return nil, fmt.Errorf("no downgrade defined for v%d", i)
+		}
+		h := s.hooks[int(i)]
+		steps = append(steps, PlanStep{
+			Version: i,
+			SQL:     sql,
+			Hooks:   h.preDowngrade != nil || h.postDowngrade != nil,
+		})
+	}
+
+	return steps, nil
+}
+
+// Downgrade runs the downgrade SQL and hooks for each version from
+// currentVersion down to targetVersion+1, in descending order.
+// Returns an error without running anything if a downgrade has not
+// been defined for every version in that range.
+func (s *SqlSchema) Downgrade(tx sqlx.Ext, currentVersion int32, targetVersion int32) error {
+	if targetVersion < 1 || targetVersion >= currentVersion {
+		return fmt.Errorf("invalid downgrade from v%d to v%d", currentVersion, targetVersion)
+	}
+
+	for i := currentVersion; i > targetVersion; i-- {
+		if _, ok := s.downgrades[int(i)]; !ok {
+			return fmt.Errorf("no downgrade defined for v%d", i)
+		}
+	}
+
+	if s.RecordHistory {
+		if err := createMigrationsTable(tx); err != nil {
+			return fmt.Errorf("unable to create %s: %w", migrationsTable, err)
+		}
+	}
+
+	for i := currentVersion; i > targetVersion; i-- {
+		version := int(i)
+		if h, ok := s.hooks[version]; ok && h.preDowngrade != nil {
+			if err := h.preDowngrade(tx); err != nil {
+				return fmt.Errorf("error during v%d pre-downgrade hook: %w", version, err)
 			}
 		}
-		if _, err := tx.Exec(s.versions[i]); err != nil {
-			return -1, fmt.Errorf("error during v%d schema upgrade: %w", version, err)
+		if _, err := tx.Exec(s.downgrades[version]); err != nil {
+			return fmt.Errorf("error during v%d schema downgrade: %w", version, err)
 		}
-		if h, ok := s.hooks[version]; ok && h.post != nil {
-			if err := h.post(tx); err != nil {
-				return -1, fmt.Errorf("error during v%d post-upgrade hook: %w", version, err)
+		if h, ok := s.hooks[version]; ok && h.postDowngrade != nil {
+			if err := h.postDowngrade(tx); err != nil {
+				return fmt.Errorf("error during v%d post-downgrade hook: %w", version, err)
+			}
+		}
+		if s.RecordHistory {
+			if err := forgetMigration(tx, version); err != nil {
+				return fmt.Errorf("unable to remove v%d from %s: %w", version, migrationsTable, err)
 			}
 		}
 	}
 
-	return newVersion, nil
+	return nil
 }
 
 func (s *SqlSchema) Copy() Schema {
@@ -208,9 +613,14 @@ func (s *SqlSchema) Copy() Schema {
 		dupeHooks[k] = v
 	}
 	return &SqlSchema{
-		ID:       s.ID,
-		versions: dupe,
-		hooks:    dupeHooks,
-		legacy:   s.legacy,
+		ID:            s.ID,
+		VersionStorer: s.VersionStorer,
+		RecordHistory: s.RecordHistory,
+		versions:      dupe,
+		funcs:         maps.Clone(s.funcs),
+		noTx:          maps.Clone(s.noTx),
+		downgrades:    maps.Clone(s.downgrades),
+		hooks:         dupeHooks,
+		legacy:        s.legacy,
 	}
 }
@@ -0,0 +1,78 @@
+package localdb
+
+import (
+	"fmt"
+	"io/fs"
+	"maps"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+)
+
+var migrationFilePattern = regexp.MustCompile(`^(\d+)_[^/]*\.sql$`)
+
+// NewSqlSchemaFS builds a SqlSchema from the .sql files in dir,
+// which is read from fsys (typically an embed.FS).
+//
+// Each file name must start with its version number, followed by
+// an underscore, such as "0001_root.sql" and "0002_add_email.sql".
+// Leading zeroes are optional. Version 1 is the root schema, and
+// versions must be contiguous. Files without a .sql extension are
+// ignored, as are subdirectories.
+//
+// The result is identical to calling NewSqlSchema with the
+// contents of version 1, followed by DefineUpgrade for each
+// subsequent version.
+func NewSqlSchemaFS(fsys fs.FS, dir string) (*SqlSchema, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[int]string)
+	for _, entry := range entries {
+		if entry.IsDir() || path.Ext(entry.Name()) != ".sql" {
+			continue
+		}
+
+		m := migrationFilePattern.FindStringSubmatch(entry.Name())
+		if m == nil {
+			return nil, fmt.Errorf("%s: migration file names must take the form NNNN_description.sql", path.Join(dir, entry.Name()))
+		}
+		version, err := strconv.Atoi(m[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid version: %w", path.Join(dir, entry.Name()), err)
+		}
+		if prev, ok := files[version]; ok {
+			return nil, fmt.Errorf("%s: duplicate v%d, already defined by %s", path.Join(dir, entry.Name()), version, prev)
+		}
+		files[version] = entry.Name()
+	}
+
+	if len(files) == 0 {
+		return nil, fmt.Errorf("%s: no migration files found", dir)
+	}
+
+	versions := slices.Sorted(maps.Keys(files))
+	for i, v := range versions {
+		if v != i+1 {
+			return nil, fmt.Errorf("%s: missing v%d, versions must be contiguous starting from 1", dir, i+1)
+		}
+	}
+
+	var schema *SqlSchema
+	for _, v := range versions {
+		contents, err := fs.ReadFile(fsys, path.Join(dir, files[v]))
+		if err != nil {
+			return nil, err
+		}
+
+		if v == 1 {
+			schema = NewSqlSchema(string(contents))
+		} else {
+			schema.DefineUpgrade(v, string(contents))
+		}
+	}
+	return schema, nil
+}
@@ -0,0 +1,47 @@
+package localdb
+
+import (
+	"testing/fstest"
+)
+
+func (suite *DBTestSuite) TestNewSqlSchemaFS() {
+	root := `CREATE TABLE t ( foo TEXT );`
+	upgrade := `ALTER TABLE t ADD COLUMN bar TEXT;`
+
+	schema, err := NewSqlSchemaFS(fstest.MapFS{
+		"migrations/0001_root.sql":    {Data: []byte(root)},
+		"migrations/0002_add_bar.sql": {Data: []byte(upgrade)},
+		"migrations/README.md":        {Data: []byte("ignored")},
+		"migrations/old/0003_x.sql":   {Data: []byte("ignored")},
+	}, "migrations")
+	suite.Require().NoError(err)
+
+	expected := NewSqlSchema(root)
+	expected.DefineUpgrade(2, upgrade)
+	suite.Require().Equal(expected, schema)
+
+	cases := map[string]fstest.MapFS{
+		"migrations: no migration files found": {
+			"migrations/README.md": {},
+		},
+		"migrations: missing v2, versions must be contiguous starting from 1": {
+			"migrations/0001_root.sql": {},
+			"migrations/0003_x.sql":    {},
+		},
+		"migrations: missing v1, versions must be contiguous starting from 1": {
+			"migrations/0002_x.sql": {},
+		},
+		"migrations/2_y.sql: duplicate v2, already defined by 0002_x.sql": {
+			"migrations/0001_root.sql": {},
+			"migrations/0002_x.sql":    {},
+			"migrations/2_y.sql":       {},
+		},
+		"migrations/root.sql: migration file names must take the form NNNN_description.sql": {
+			"migrations/root.sql": {},
+		},
+	}
+	for expectedErr, fsys := range cases {
+		_, err := NewSqlSchemaFS(fsys, "migrations")
+		suite.Require().EqualError(err, expectedErr)
+	}
+}
@@ -0,0 +1,223 @@
+package localdb
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// snapshotChunkSize is the granularity of progress reports
+// while copying a snapshot.
+const snapshotChunkSize = 1 << 20
+
+// BackupProgress is passed to OpenOptions.OnBackupProgress.
+type BackupProgress struct {
+	// Dest is the destination file, or empty for DB.BackupTo.
+	Dest string
+
+	// Written is the number of bytes of the snapshot written to
+	// the destination so far. When OpenOptions.BackupTransforms
+	// are set, this counts bytes before they are transformed, so
+	// that it can be compared with Total.
+	Written int64
+
+	// Total is the size of the snapshot. Before the snapshot has
+	// been taken, Total is an estimate based on the database's
+	// page count.
+	Total int64
+}
+
+func (d *DB) reportBackupProgress(p BackupProgress) {
+	if d.onBackupProgress != nil {
+		d.onBackupProgress(p)
+	}
+}
+
+// Backup writes a consistent snapshot of the live database to dest,
+// returning the number of bytes written. The snapshot is encoded
+// with OpenOptions.BackupTransforms, if any; unlike the backups
+// taken by Open, their suffixes are not added to dest.
+//
+// The snapshot is taken with VACUUM INTO, into a temporary file in
+// the same directory as dest, which is then renamed over dest. If
+// a read pool was configured (see OpenOptions.ReadConns), the
+// snapshot is taken on a read connection, so writers are not
+// blocked while it runs. Otherwise it occupies a writer connection
+// for the duration of the VACUUM INTO.
+func (d *DB) Backup(ctx context.Context, dest string) (int64, error) {
+	d.reportBackupProgress(BackupProgress{Dest: dest, Total: d.estimateSize(ctx)})
+
+	size, total, err := d.snapshotTo(ctx, dest)
+	if err != nil {
+		return 0, err
+	}
+
+	d.reportBackupProgress(BackupProgress{Dest: dest, Written: total, Total: total})
+	return size, nil
+}
+
+// BackupTo is like Backup, but copies the snapshot to w. The
+// snapshot is staged in a temporary file next to the database,
+// which is removed before BackupTo returns. No database lock is
+// held while w is written to.
+func (d *DB) BackupTo(ctx context.Context, w io.Writer) (written int64, err error) {
+	d.reportBackupProgress(BackupProgress{Total: d.estimateSize(ctx)})
+
+	tmp, err := os.CreateTemp(filepath.Dir(d.file), filepath.Base(d.file)+".snapshot-*")
+	if err != nil {
+		return 0, err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	if err = d.vacuumInto(ctx, tmp.Name()); err != nil {
+		return 0, err
+	}
+
+	f, err := os.Open(tmp.Name())
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	total := info.Size()
+
+	counter := &countingWriter{w: w}
+	defer func() { written = counter.n }()
+
+	enc, err := encodeBackup(counter, d.options.BackupTransforms)
+	if err != nil {
+		return 0, err
+	}
+
+	var copied int64
+	buf := make([]byte, snapshotChunkSize)
+	for {
+		if err = ctx.Err(); err != nil {
+			enc.Close()
+			return 0, err
+		}
+
+		n, readErr := f.Read(buf)
+		if n > 0 {
+			if _, err = enc.Write(buf[:n]); err != nil {
+				enc.Close()
+				return 0, err
+			}
+			copied += int64(n)
+			d.reportBackupProgress(BackupProgress{Written: copied, Total: total})
+		}
+		if readErr == io.EOF {
+			return 0, enc.Close()
+		} else if readErr != nil {
+			enc.Close()
+			return 0, readErr
+		}
+	}
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// snapshotTo atomically replaces dest with a snapshot of the
+// database, returning the size of dest and of the snapshot
+// before it was transformed.
+func (d *DB) snapshotTo(ctx context.Context, dest string) (size, total int64, err error) {
+	dir := filepath.Dir(dest)
+	tmp, err := os.CreateTemp(dir, filepath.Base(dest)+".tmp-*")
+	if err != nil {
+		return 0, 0, err
+	}
+	tmp.Close()
+	defer func() {
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	// With transforms, the snapshot is staged in a second
+	// temporary file and encoded into the first.
+	staged := tmp.Name()
+	transforms := d.options.BackupTransforms
+	if len(transforms) != 0 {
+		stage, err := os.CreateTemp(dir, filepath.Base(dest)+".tmp-*")
+		if err != nil {
+			return 0, 0, err
+		}
+		stage.Close()
+		defer os.Remove(stage.Name())
+		staged = stage.Name()
+	}
+
+	if err = d.vacuumInto(ctx, staged); err != nil {
+		return 0, 0, err
+	}
+	info, err := os.Stat(staged)
+	if err != nil {
+		return 0, 0, err
+	}
+	total = info.Size()
+
+	f, err := os.OpenFile(tmp.Name(), os.O_RDWR, 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	if staged != tmp.Name() {
+		err = encodeBackupFile(f, staged, transforms)
+	}
+	if err == nil {
+		info, err = f.Stat()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	size = info.Size()
+
+	if err = os.Rename(tmp.Name(), dest); err != nil {
+		return 0, 0, err
+	}
+	return size, total, syncDir(dir)
+}
+
+// vacuumInto writes a snapshot to path, which must not exist
+// or be empty.
+func (d *DB) vacuumInto(ctx context.Context, path string) error {
+	pool := d.readPool()
+	if _, err := bindContext(ctx, pool.DriverName(), pool).Exec(`VACUUM INTO ?`, path); err != nil {
+		return fmt.Errorf("unable to snapshot database: %w", err)
+	}
+	return nil
+}
+
+// estimateSize returns the approximate size of a snapshot,
+// or 0 if it cannot be determined.
+func (d *DB) estimateSize(ctx context.Context) int64 {
+	var size int64
+	pool := d.readPool()
+	row := pool.QueryRowxContext(ctx, `SELECT page_count * page_size FROM pragma_page_count, pragma_page_size`)
+	if err := row.Scan(&size); err != nil {
+		return 0
+	}
+	return size
+}
@@ -0,0 +1,73 @@
+package localdb
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func (suite *DBTestSuite) TestBackup() {
+	dir := filepath.Dir(suite.DBFile)
+	var progress []BackupProgress
+	db, err := Open(OpenOptions{
+		File:       suite.DBFile,
+		Schema:     NewSqlSchema(`CREATE TABLE t ( foo TEXT )`),
+		DriverName: "sqlite",
+		ReadConns:  1,
+		OnBackupProgress: func(p BackupProgress) {
+			progress = append(progress, p)
+		},
+	})
+	suite.Require().NoError(err)
+	defer db.Close()
+
+	_, err = db.Handle().Exec(`INSERT INTO t (foo) VALUES (?)`, "committed")
+	suite.Require().NoError(err)
+
+	dest := filepath.Join(dir, "snapshot.db")
+	suite.Require().NoError(db.WrapTx(func(tx sqlx.Ext) error {
+		if _, err := tx.Exec(`INSERT INTO t (foo) VALUES (?)`, "uncommitted"); err != nil {
+			return err
+		}
+
+		// The read pool takes the snapshot while the writer is busy
+		size, err := db.Backup(context.Background(), dest)
+		suite.Require().NoError(err)
+		info, err := os.Stat(dest)
+		suite.Require().NoError(err)
+		suite.Require().Equal(info.Size(), size)
+		return nil
+	}))
+
+	suite.Require().NotEmpty(progress)
+	suite.Require().Equal(dest, progress[len(progress)-1].Dest)
+	suite.Require().Equal(progress[len(progress)-1].Total, progress[len(progress)-1].Written)
+
+	var foos []string
+	suite.Require().NoError(sqlx.Select(openRaw(suite.T(), dest), &foos, `SELECT foo FROM t`))
+	suite.Require().Equal([]string{"committed"}, foos)
+
+	matches, err := filepath.Glob(filepath.Join(dir, "*.tmp-*"))
+	suite.Require().NoError(err)
+	suite.Require().Empty(matches, "temporary files should be cleaned up")
+
+	progress = nil
+	var buf bytes.Buffer
+	written, err := db.BackupTo(context.Background(), &buf)
+	suite.Require().NoError(err)
+	suite.Require().Equal(int64(buf.Len()), written)
+	suite.Require().Equal(written, progress[len(progress)-1].Written)
+
+	streamed := filepath.Join(dir, "streamed.db")
+	suite.Require().NoError(os.WriteFile(streamed, buf.Bytes(), 0600))
+	foos = nil
+	suite.Require().NoError(sqlx.Select(openRaw(suite.T(), streamed), &foos, `SELECT foo FROM t ORDER BY rowid`))
+	suite.Require().Equal([]string{"committed", "uncommitted"}, foos)
+
+	matches, err = filepath.Glob(filepath.Join(dir, "*.snapshot-*"))
+	suite.Require().NoError(err)
+	suite.Require().Empty(matches, "temporary files should be cleaned up")
+}
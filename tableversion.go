@@ -0,0 +1,212 @@
+package localdb
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// metaTable is a key/value table holding the version information
+// written by TableVersion, and other localdb bookkeeping.
+const metaTable = "localdb_meta"
+
+// Keys in the localdb_meta table.
+const (
+	metaApplicationID = "application_id"
+	metaUserVersion   = "user_version"
+	metaSchemaName    = "schema_name"
+	metaBinaryVersion = "binary_version"
+	metaCreatedAt     = "created_at"
+	metaUpdatedAt     = "updated_at"
+
+	// Written by FallbackVersion.Migrate
+	metaFallbackMigratedAt = "fallback_migrated_at"
+)
+
+// TableVersion stores version information in a localdb_meta
+// key/value table, rather than in the application_id and
+// user_version pragmas, leaving those free for other tools.
+// Alongside the application ID and version, it records the
+// optional SchemaName and BinaryVersion, and when the database
+// was created and last upgraded.
+//
+// If the table does not exist, the application ID and version
+// read as 0. To migrate existing databases from SqliteVersion,
+// wrap TableVersion in a FallbackVersion:
+//
+//	&FallbackVersion{
+//		VersionStorer:  &TableVersion{},
+//		FallbackReader: &SqliteVersion{},
+//	}
+type TableVersion struct {
+	// SchemaName, if non-empty, is recorded with the
+	// application ID to identify the schema.
+	SchemaName string
+
+	// BinaryVersion, if non-empty, is recorded each time the
+	// version is updated, such as the application's release.
+	BinaryVersion string
+}
+
+// TableMetadata is the contents of the localdb_meta table,
+// as returned by TableVersion.Metadata.
+type TableMetadata struct {
+	ApplicationID int32
+	UserVersion   int32
+	SchemaName    string
+
+	// BinaryVersion is the TableVersion.BinaryVersion that
+	// last updated the version.
+	BinaryVersion string
+
+	// CreatedAt is when the table was first written.
+	CreatedAt time.Time
+
+	// UpdatedAt is when the application ID or version
+	// was last written.
+	UpdatedAt time.Time
+}
+
+func (tv *TableVersion) GetApplicationId(tx sqlx.Queryer) (appId int32, err error) {
+	return tv.getInt(tx, metaApplicationID)
+}
+
+func (tv *TableVersion) GetUserVersion(tx sqlx.Queryer) (version int32, err error) {
+	return tv.getInt(tx, metaUserVersion)
+}
+
+func (tv *TableVersion) SetApplicationId(tx sqlx.Execer, appId int32) error {
+	values := map[string]string{metaApplicationID: strconv.Itoa(int(appId))}
+	if tv.SchemaName != "" {
+		values[metaSchemaName] = tv.SchemaName
+	}
+	return tv.set(tx, values)
+}
+
+func (tv *TableVersion) SetUserVersion(tx sqlx.Execer, version int32) error {
+	values := map[string]string{metaUserVersion: strconv.Itoa(int(version))}
+	if tv.BinaryVersion != "" {
+		values[metaBinaryVersion] = tv.BinaryVersion
+	}
+	return tv.set(tx, values)
+}
+
+// Metadata returns the contents of the localdb_meta table.
+// If the table does not exist, every field is zero.
+func (tv *TableVersion) Metadata(q sqlx.Queryer) (*TableMetadata, error) {
+	m := &TableMetadata{}
+	exists, err := tableExists(q, metaTable)
+	if err != nil || !exists {
+		return m, err
+	}
+
+	var rows []struct {
+		Key   string `db:"key"`
+		Value string `db:"value"`
+	}
+	if err = sqlx.Select(q, &rows, `SELECT key, value FROM `+metaTable); err != nil {
+		return nil, err
+	}
+
+	for _, row := range rows {
+		switch row.Key {
+		case metaApplicationID:
+			m.ApplicationID, err = parseMetaInt(row.Key, row.Value)
+		case metaUserVersion:
+			m.UserVersion, err = parseMetaInt(row.Key, row.Value)
+		case metaSchemaName:
+			m.SchemaName = row.Value
+		case metaBinaryVersion:
+			m.BinaryVersion = row.Value
+		case metaCreatedAt:
+			m.CreatedAt, err = parseMetaTime(row.Key, row.Value)
+		case metaUpdatedAt:
+			m.UpdatedAt, err = parseMetaTime(row.Key, row.Value)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func (tv *TableVersion) getInt(q sqlx.Queryer, key string) (int32, error) {
+	value, ok, err := getMeta(q, key)
+	if err != nil || !ok {
+		return 0, err
+	}
+	return parseMetaInt(key, value)
+}
+
+// set writes values, and updates the table's timestamps.
+func (tv *TableVersion) set(tx sqlx.Execer, values map[string]string) error {
+	if err := createMetaTable(tx); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	if _, err := tx.Exec(`INSERT OR IGNORE INTO `+metaTable+` (key, value) VALUES (?, ?)`, metaCreatedAt, now); err != nil {
+		return err
+	}
+	values[metaUpdatedAt] = now
+
+	for key, value := range values {
+		if err := putMeta(tx, key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func createMetaTable(tx sqlx.Execer) error {
+	if _, err := tx.Exec(`CREATE TABLE IF NOT EXISTS ` + metaTable + ` (
+	key TEXT PRIMARY KEY,
+	value TEXT NOT NULL
+)`); err != nil {
+		return fmt.Errorf("unable to create %s: %w", metaTable, err)
+	}
+	return nil
+}
+
+// getMeta reads key from the localdb_meta table. ok is false if
+// the key or the table does not exist.
+func getMeta(q sqlx.Queryer, key string) (value string, ok bool, err error) {
+	exists, err := tableExists(q, metaTable)
+	if err != nil || !exists {
+		return "", false, err
+	}
+
+	err = q.QueryRowx(`SELECT value FROM `+metaTable+` WHERE key = ?`, key).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+// putMeta writes key to the localdb_meta table, which must exist.
+func putMeta(tx sqlx.Execer, key, value string) error {
+	_, err := tx.Exec(`INSERT OR REPLACE INTO `+metaTable+` (key, value) VALUES (?, ?)`, key, value)
+	return err
+}
+
+func parseMetaInt(key, value string) (int32, error) {
+	n, err := strconv.ParseInt(value, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s in %s: %w", key, metaTable, err)
+	}
+	return int32(n), nil
+}
+
+func parseMetaTime(key, value string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s in %s: %w", key, metaTable, err)
+	}
+	return t, nil
+}
@@ -0,0 +1,67 @@
+package localdb
+
+func (suite *DBTestSuite) TestTableVersion() {
+	schema := NewSqlSchema(`CREATE TABLE t ( foo TEXT )`)
+	tv := &TableVersion{SchemaName: "test", BinaryVersion: "1.0.0"}
+
+	db, err := Open(OpenOptions{File: suite.DBFile, Schema: schema, DriverName: "sqlite", VersionStorer: tv})
+	suite.Require().NoError(err)
+
+	meta, err := tv.Metadata(db.Handle())
+	suite.Require().NoError(err)
+	suite.Require().Equal(schema.ApplicationID(), meta.ApplicationID)
+	suite.Require().Equal(int32(1), meta.UserVersion)
+	suite.Require().Equal("test", meta.SchemaName)
+	suite.Require().Equal("1.0.0", meta.BinaryVersion)
+	suite.Require().False(meta.CreatedAt.IsZero())
+	created := meta.CreatedAt
+
+	pragmas := &SqliteVersion{}
+	userVersion, err := pragmas.GetUserVersion(db.Handle())
+	suite.Require().NoError(err)
+	suite.Require().Zero(userVersion, "pragmas should be left alone")
+	suite.Require().NoError(db.Close())
+
+	schema.DefineUpgrade(2, `ALTER TABLE t ADD COLUMN bar TEXT;`)
+	tv.BinaryVersion = "1.1.0"
+	db, err = Open(OpenOptions{File: suite.DBFile, Schema: schema, DriverName: "sqlite", VersionStorer: tv})
+	suite.Require().NoError(err)
+	defer db.Close()
+
+	meta, err = tv.Metadata(db.Handle())
+	suite.Require().NoError(err)
+	suite.Require().Equal(int32(2), meta.UserVersion)
+	suite.Require().Equal("1.1.0", meta.BinaryVersion)
+	suite.Require().Equal(created, meta.CreatedAt)
+	suite.Require().False(meta.UpdatedAt.Before(created))
+
+	diff, err := db.VerifySchema()
+	suite.Require().NoError(err)
+	suite.Require().True(diff.Empty(), diff.String())
+}
+
+func (suite *DBTestSuite) TestTableVersionFromPragmas() {
+	schema := NewSqlSchema(`CREATE TABLE t ( foo TEXT )`)
+
+	db, err := Open(OpenOptions{File: suite.DBFile, Schema: schema, DriverName: "sqlite"})
+	suite.Require().NoError(err)
+	suite.Require().NoError(db.Close())
+
+	tv := &TableVersion{}
+	meta, err := tv.Metadata(openRaw(suite.T(), suite.DBFile))
+	suite.Require().NoError(err)
+	suite.Require().Equal(&TableMetadata{}, meta)
+
+	schema.DefineUpgrade(2, `ALTER TABLE t ADD COLUMN bar TEXT;`)
+	db, err = Open(OpenOptions{File: suite.DBFile, Schema: schema, DriverName: "sqlite", VersionStorer: &FallbackVersion{
+		VersionStorer:  tv,
+		FallbackReader: &SqliteVersion{},
+	}})
+	suite.Require().NoError(err, "v1 should be read from the pragmas and upgraded, not re-initialized")
+	defer db.Close()
+
+	meta, err = tv.Metadata(db.Handle())
+	suite.Require().NoError(err)
+	suite.Require().Equal(schema.ApplicationID(), meta.ApplicationID)
+	suite.Require().Equal(int32(2), meta.UserVersion)
+}
@@ -0,0 +1,328 @@
+package localdb
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// BackupTransform encodes backup files as they are written, and
+// decodes them when they are restored. See
+// OpenOptions.BackupTransforms.
+type BackupTransform interface {
+	// Ext is appended to the names of backup files written with
+	// this transform, such as ".gz".
+	Ext() string
+
+	// Encode returns a writer that encodes everything written to
+	// it into w. Closing the returned writer must flush any
+	// buffered output, but must not close w.
+	Encode(w io.Writer) (io.WriteCloser, error)
+
+	// Decode returns a reader that decodes the output of Encode
+	// read from r. Closing the returned reader must not close r.
+	Decode(r io.Reader) (io.ReadCloser, error)
+}
+
+// GzipTransform compresses backups with compress/gzip.
+type GzipTransform struct {
+	// Level is a compress/gzip compression level.
+	// Zero means gzip.DefaultCompression.
+	Level int
+}
+
+func (GzipTransform) Ext() string {
+	return ".gz"
+}
+
+func (g GzipTransform) Encode(w io.Writer) (io.WriteCloser, error) {
+	level := g.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	return gzip.NewWriterLevel(w, level)
+}
+
+func (GzipTransform) Decode(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// ErrBackupDecrypt is returned (wrapped) when an encrypted backup
+// cannot be decrypted, because the key is wrong or the file has
+// been truncated or modified.
+var ErrBackupDecrypt = errors.New("unable to decrypt backup")
+
+const (
+	aesgcmMagic       = "LDBGCM\x00\x01"
+	aesgcmPrefixSize  = 7
+	aesgcmChunkSize   = 64 << 10
+	aesgcmHeaderSize  = len(aesgcmMagic) + aesgcmPrefixSize
+	aesgcmFinalChunk  = 1
+	aesgcmNormalChunk = 0
+)
+
+// AESGCMTransform encrypts backups with AES-GCM using a
+// caller-supplied key.
+//
+// The backup is split into 64 KiB chunks, each sealed separately
+// with a nonce derived from a random per-file prefix and the chunk's
+// position, so that chunks cannot be reordered, and the final chunk
+// is marked so that truncation is detected. Decode returns an error
+// wrapping ErrBackupDecrypt if any chunk fails authentication; data
+// read before that point must be discarded.
+type AESGCMTransform struct {
+	aead cipher.AEAD
+}
+
+// NewAESGCMTransform returns an AESGCMTransform using key, which
+// must be 16, 24 or 32 bytes long to select AES-128, AES-192 or
+// AES-256.
+func NewAESGCMTransform(key []byte) (*AESGCMTransform, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &AESGCMTransform{aead: aead}, nil
+}
+
+func (*AESGCMTransform) Ext() string {
+	return ".enc"
+}
+
+func (a *AESGCMTransform) Encode(w io.Writer) (io.WriteCloser, error) {
+	header := make([]byte, aesgcmHeaderSize)
+	copy(header, aesgcmMagic)
+	if _, err := rand.Read(header[len(aesgcmMagic):]); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	g := &aesgcmWriter{
+		aesgcmChunker: aesgcmChunker{aead: a.aead},
+		w:             w,
+		buf:           make([]byte, 0, aesgcmChunkSize+a.aead.Overhead()),
+	}
+	copy(g.prefix[:], header[len(aesgcmMagic):])
+	return g, nil
+}
+
+func (a *AESGCMTransform) Decode(r io.Reader) (io.ReadCloser, error) {
+	header := make([]byte, aesgcmHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("%w: missing header: %v", ErrBackupDecrypt, err)
+	}
+	if string(header[:len(aesgcmMagic)]) != aesgcmMagic {
+		return nil, fmt.Errorf("%w: not an AES-GCM backup", ErrBackupDecrypt)
+	}
+
+	g := &aesgcmReader{
+		aesgcmChunker: aesgcmChunker{aead: a.aead},
+		r:             bufio.NewReader(r),
+		buf:           make([]byte, aesgcmChunkSize+a.aead.Overhead()),
+	}
+	copy(g.prefix[:], header[len(aesgcmMagic):])
+	return g, nil
+}
+
+type aesgcmChunker struct {
+	aead    cipher.AEAD
+	prefix  [aesgcmPrefixSize]byte
+	counter uint32
+}
+
+// nonce returns the nonce for the next chunk, which is the file's
+// random prefix, followed by the chunk counter and a final flag.
+func (c *aesgcmChunker) nonce(final bool) ([]byte, error) {
+	if c.counter == math.MaxUint32 {
+		return nil, errors.New("backup too large to encrypt")
+	}
+	nonce := make([]byte, c.aead.NonceSize())
+	copy(nonce, c.prefix[:])
+	binary.BigEndian.PutUint32(nonce[aesgcmPrefixSize:], c.counter)
+	nonce[len(nonce)-1] = aesgcmNormalChunk
+	if final {
+		nonce[len(nonce)-1] = aesgcmFinalChunk
+	}
+	c.counter++
+	return nonce, nil
+}
+
+type aesgcmWriter struct {
+	aesgcmChunker
+	w      io.Writer
+	buf    []byte
+	closed bool
+}
+
+func (g *aesgcmWriter) Write(p []byte) (n int, err error) {
+	if g.closed {
+		return 0, errors.New("write to closed encrypter")
+	}
+	for len(p) > 0 {
+		// A full chunk is only flushed once more data arrives,
+		// since the last chunk must be sealed as final.
+		if len(g.buf) == aesgcmChunkSize {
+			if err = g.flush(false); err != nil {
+				return n, err
+			}
+		}
+		m := min(len(p), aesgcmChunkSize-len(g.buf))
+		g.buf = append(g.buf, p[:m]...)
+		p = p[m:]
+		n += m
+	}
+	return n, nil
+}
+
+func (g *aesgcmWriter) flush(final bool) error {
+	nonce, err := g.nonce(final)
+	if err != nil {
+		return err
+	}
+	sealed := g.aead.Seal(g.buf[:0], nonce, g.buf, nil)
+	g.buf = g.buf[:0]
+	_, err = g.w.Write(sealed)
+	return err
+}
+
+func (g *aesgcmWriter) Close() error {
+	if g.closed {
+		return nil
+	}
+	g.closed = true
+	return g.flush(true)
+}
+
+type aesgcmReader struct {
+	aesgcmChunker
+	r     *bufio.Reader
+	buf   []byte
+	plain []byte
+	done  bool
+	err   error
+}
+
+func (g *aesgcmReader) Read(p []byte) (int, error) {
+	for len(g.plain) == 0 {
+		if g.err != nil {
+			return 0, g.err
+		}
+		if g.done {
+			return 0, io.EOF
+		}
+		g.err = g.next()
+	}
+	n := copy(p, g.plain)
+	g.plain = g.plain[n:]
+	return n, nil
+}
+
+// next decrypts the next chunk into g.plain.
+func (g *aesgcmReader) next() error {
+	n, err := io.ReadFull(g.r, g.buf)
+	var final bool
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		final = true
+	case err != nil:
+		return err
+	default:
+		// A full chunk is final only if nothing follows it
+		if _, err = g.r.Peek(1); err == io.EOF {
+			final = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	nonce, err := g.nonce(final)
+	if err != nil {
+		return err
+	}
+	g.plain, err = g.aead.Open(g.buf[:0], nonce, g.buf[:n], nil)
+	if err != nil {
+		return fmt.Errorf("%w: chunk %d failed authentication", ErrBackupDecrypt, g.counter-1)
+	}
+	g.done = final
+	return nil
+}
+
+func (g *aesgcmReader) Close() error {
+	return nil
+}
+
+// encodeBackup returns a writer that applies transforms, in order,
+// to everything written to it before writing it to w. Closing the
+// returned writer flushes every transform, but does not close w.
+func encodeBackup(w io.Writer, transforms []BackupTransform) (io.WriteCloser, error) {
+	chain := &transformChain{w: w}
+	for i := len(transforms) - 1; i >= 0; i-- {
+		wc, err := transforms[i].Encode(chain.w)
+		if err != nil {
+			return nil, errors.Join(err, chain.Close())
+		}
+		chain.w = wc
+		chain.closers = append(chain.closers, wc)
+	}
+	return chain, nil
+}
+
+// decodeBackup returns a reader that reverses encodeBackup.
+func decodeBackup(r io.Reader, transforms []BackupTransform) (io.ReadCloser, error) {
+	chain := &transformChain{r: r}
+	for i := len(transforms) - 1; i >= 0; i-- {
+		rc, err := transforms[i].Decode(chain.r)
+		if err != nil {
+			return nil, errors.Join(err, chain.Close())
+		}
+		chain.r = rc
+		chain.closers = append(chain.closers, rc)
+	}
+	return chain, nil
+}
+
+type transformChain struct {
+	w       io.Writer
+	r       io.Reader
+	closers []io.Closer
+}
+
+func (c *transformChain) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+func (c *transformChain) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// Close closes each transform, outermost first, so that each
+// flushes into the next before it is closed.
+func (c *transformChain) Close() error {
+	var errs []error
+	for i := len(c.closers) - 1; i >= 0; i-- {
+		errs = append(errs, c.closers[i].Close())
+	}
+	return errors.Join(errs...)
+}
+
+// backupExt returns the suffix that transforms add to a backup name.
+func backupExt(transforms []BackupTransform) string {
+	var ext string
+	for _, t := range transforms {
+		ext += t.Ext()
+	}
+	return ext
+}
@@ -0,0 +1,144 @@
+package localdb
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func (suite *DBTestSuite) TestAESGCMTransform() {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	suite.Require().NoError(err)
+	aesgcm, err := NewAESGCMTransform(key)
+	suite.Require().NoError(err)
+
+	_, err = NewAESGCMTransform(key[:10])
+	suite.Require().Error(err)
+
+	encode := func(plain []byte, transforms ...BackupTransform) []byte {
+		var buf bytes.Buffer
+		w, err := encodeBackup(&buf, transforms)
+		suite.Require().NoError(err)
+		_, err = w.Write(plain)
+		suite.Require().NoError(err)
+		suite.Require().NoError(w.Close())
+		return buf.Bytes()
+	}
+	decode := func(encoded []byte, transforms ...BackupTransform) ([]byte, error) {
+		r, err := decodeBackup(bytes.NewReader(encoded), transforms)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	}
+
+	for _, size := range []int{0, 1, aesgcmChunkSize, aesgcmChunkSize + 1, 3 * aesgcmChunkSize} {
+		plain := make([]byte, size)
+		_, err = rand.Read(plain)
+		suite.Require().NoError(err)
+
+		encoded := encode(plain, aesgcm)
+		decoded, err := decode(encoded, aesgcm)
+		suite.Require().NoError(err, "size %d", size)
+		suite.Require().Equal(plain, decoded, "size %d", size)
+
+		decoded, err = decode(encode(plain, GzipTransform{}, aesgcm), GzipTransform{}, aesgcm)
+		suite.Require().NoError(err, "size %d", size)
+		suite.Require().Equal(plain, decoded, "size %d", size)
+	}
+
+	plain := bytes.Repeat([]byte("localdb"), aesgcmChunkSize)
+	encoded := encode(plain, aesgcm)
+
+	otherKey := make([]byte, 32)
+	other, err := NewAESGCMTransform(otherKey)
+	suite.Require().NoError(err)
+	_, err = decode(encoded, other)
+	suite.Require().ErrorIs(err, ErrBackupDecrypt)
+
+	// Truncated at a chunk boundary, so every remaining chunk is intact
+	chunk := aesgcmChunkSize + 16
+	_, err = decode(encoded[:aesgcmHeaderSize+2*chunk], aesgcm)
+	suite.Require().ErrorIs(err, ErrBackupDecrypt)
+
+	tampered := bytes.Clone(encoded)
+	tampered[len(tampered)/2] ^= 1
+	_, err = decode(tampered, aesgcm)
+	suite.Require().ErrorIs(err, ErrBackupDecrypt)
+
+	_, err = decode(plain, aesgcm)
+	suite.Require().ErrorIs(err, ErrBackupDecrypt)
+}
+
+func (suite *DBTestSuite) TestBackupTransforms() {
+	dir := filepath.Dir(suite.DBFile)
+	aesgcm, err := NewAESGCMTransform(bytes.Repeat([]byte{1}, 16))
+	suite.Require().NoError(err)
+	transforms := []BackupTransform{GzipTransform{}, aesgcm}
+
+	schema := NewSqlSchema(`CREATE TABLE t ( foo TEXT )`)
+	options := OpenOptions{
+		File:             suite.DBFile,
+		Schema:           schema,
+		DriverName:       "sqlite",
+		BackupDir:        filepath.Join(dir, "backups"),
+		BackupTransforms: transforms,
+		VerifyBackup:     true,
+	}
+
+	db, err := Open(options)
+	suite.Require().NoError(err)
+	_, err = db.Handle().Exec(`INSERT INTO t (foo) VALUES (?)`, "original")
+	suite.Require().NoError(err)
+	suite.Require().NoError(db.Close())
+
+	schema.DefineUpgrade(2, `ALTER TABLE t ADD COLUMN bar TEXT;`)
+	db, err = Open(options)
+	suite.Require().NoError(err)
+	defer db.Close()
+
+	suite.Require().Equal([]string{"test.before_v2_upgrade.db.gz.enc"}, backupNames(suite.T(), options))
+	matches, err := filepath.Glob(filepath.Join(options.BackupDir, "*.tmp-*"))
+	suite.Require().NoError(err)
+	suite.Require().Empty(matches, "temporary files should be cleaned up")
+
+	selectFoos := func(file string) []string {
+		var foos []string
+		suite.Require().NoError(sqlx.Select(openRaw(suite.T(), file), &foos, `SELECT foo FROM t`))
+		return foos
+	}
+
+	backup := filepath.Join(options.BackupDir, "test.before_v2_upgrade.db.gz.enc")
+	raw, err := os.ReadFile(backup)
+	suite.Require().NoError(err)
+	suite.Require().False(bytes.Contains(raw, []byte("original")), "backup should be encrypted")
+
+	restored := filepath.Join(dir, "restored.db")
+	suite.Require().NoError(RestoreBackup(backup, restored, transforms))
+	suite.Require().Equal([]string{"original"}, selectFoos(restored))
+
+	snapshot := filepath.Join(dir, "snapshot.db.gz.enc")
+	_, err = db.Backup(context.Background(), snapshot)
+	suite.Require().NoError(err)
+	suite.Require().NoError(RestoreBackup(snapshot, restored, transforms))
+	suite.Require().Equal([]string{"original"}, selectFoos(restored))
+
+	var buf bytes.Buffer
+	written, err := db.BackupTo(context.Background(), &buf)
+	suite.Require().NoError(err)
+	suite.Require().Equal(int64(buf.Len()), written)
+	streamed := filepath.Join(dir, "streamed.db.gz.enc")
+	suite.Require().NoError(os.WriteFile(streamed, buf.Bytes(), 0600))
+	suite.Require().NoError(RestoreBackup(streamed, restored, transforms))
+	suite.Require().Equal([]string{"original"}, selectFoos(restored))
+
+	suite.Require().Error(RestoreBackup(streamed, restored, []BackupTransform{GzipTransform{}}))
+	suite.Require().Equal([]string{"original"}, selectFoos(restored), "failed restore should leave dest in place")
+}
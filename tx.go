@@ -0,0 +1,201 @@
+package localdb
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// TxWrapper is implemented by *DB and *Tx, allowing code to
+// open a transaction without knowing whether it is already
+// running inside one.
+type TxWrapper interface {
+	WrapTx(fn any) error
+	WrapTxContext(ctx context.Context, fn any) error
+}
+
+// Tx is the Handle passed to WrapTx callbacks.
+//
+// Calling WrapTx on a Tx runs fn inside a SAVEPOINT rather
+// than a new transaction. If fn fails, only the work done
+// since the savepoint is rolled back, and the enclosing
+// transaction may continue. Calling DB.WrapTx from inside a
+// transaction instead begins an independent transaction, which
+// will block (or deadlock, with MaxOpenConns == 1) until the
+// enclosing transaction finishes.
+type Tx struct {
+	*boundHandle
+
+	depth int
+}
+
+func newTx(b *boundHandle, depth int) *Tx {
+	return &Tx{
+		boundHandle: b,
+		depth:       depth,
+	}
+}
+
+// WrapTx runs fn within a SAVEPOINT nested in this transaction.
+// fn has the same signature requirements as DB.WrapTx. If fn
+// returns an error or panics, the savepoint is rolled back and
+// released, leaving the enclosing transaction intact.
+func (t *Tx) WrapTx(fn any) error {
+	return t.WrapTxContext(t.ctx, fn)
+}
+
+// WrapTxContext is like WrapTx, but binds the nested Handle
+// to ctx.
+func (t *Tx) WrapTxContext(ctx context.Context, fn any) (err error) {
+	f := txFunc(fn)
+
+	name := fmt.Sprintf("localdb_sp%d", t.depth+1)
+	if _, err = t.ExecContext(ctx, "SAVEPOINT "+name); err != nil {
+		return err
+	}
+
+	var once sync.Once
+	defer once.Do(func() {
+		// Reached if fn returned an error or panicked. The
+		// savepoint must be rolled back even if ctx was
+		// cancelled, or the enclosing transaction is left
+		// holding the failed work.
+		noCancel := context.WithoutCancel(ctx)
+		_, rbErr := t.ExecContext(noCancel, "ROLLBACK TO "+name)
+		if rbErr == nil {
+			_, rbErr = t.ExecContext(noCancel, "RELEASE "+name)
+		}
+		if rbErr == nil {
+			return
+		}
+		// database/sql rolls back the enclosing transaction on
+		// its own when ctx is cancelled, taking the savepoint
+		// with it.
+		if errors.Is(rbErr, sql.ErrTxDone) && ctx.Err() != nil {
+			err = ctx.Err()
+			return
+		}
+		panic(rbErr)
+	})
+
+	if err = f(newTx(bindContext(ctx, t.driverName, t.contextExt), t.depth+1)); err != nil {
+		return err
+	}
+
+	err = errDetectPanic
+	once.Do(func() {
+		_, err = t.ExecContext(ctx, "RELEASE "+name)
+	})
+	if errors.Is(err, errDetectPanic) {
+		panic("logic error")
+	}
+	if errors.Is(err, sql.ErrTxDone) && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// TxMode selects the locking behavior of a transaction.
+// See https://www.sqlite.org/lang_transaction.html
+type TxMode int
+
+const (
+	// TxDeferred acquires locks lazily, on first read and first
+	// write. This is the default for WrapTx.
+	TxDeferred TxMode = iota
+
+	// TxImmediate acquires the write lock when the transaction
+	// begins. Use this for transactions that will write, to avoid
+	// SQLITE_BUSY failures when two readers try to upgrade to
+	// writers at the same time.
+	TxImmediate
+
+	// TxExclusive is like TxImmediate, but additionally prevents
+	// other connections from reading (outside of WAL mode).
+	TxExclusive
+)
+
+func (m TxMode) String() string {
+	switch m {
+	case TxDeferred:
+		return "DEFERRED"
+	case TxImmediate:
+		return "IMMEDIATE"
+	case TxExclusive:
+		return "EXCLUSIVE"
+	default:
+		return "INVALID"
+	}
+}
+
+// WrapTxMode is like WrapTx, but begins the transaction
+// using the given TxMode.
+func (d *DB) WrapTxMode(mode TxMode, fn any) error {
+	return d.WrapTxModeContext(context.Background(), mode, fn)
+}
+
+// WrapTxModeContext is like WrapTxContext, but begins the
+// transaction using the given TxMode.
+//
+// SQLite drivers expose the transaction mode differently
+// (github.com/mattn/go-sqlite3 only via its _txlock DSN option),
+// so non-deferred transactions are run by issuing BEGIN directly
+// on a dedicated connection, which works with any driver.
+func (d *DB) WrapTxModeContext(ctx context.Context, mode TxMode, fn any) error {
+	f := txFunc(fn)
+
+	switch mode {
+	case TxDeferred:
+		return d.retry.withRetry(ctx, func() error {
+			return d.wrapTx(ctx, d.root, nil, f)
+		})
+	case TxImmediate, TxExclusive:
+		return d.retry.withRetry(ctx, func() error {
+			return d.wrapTxMode(ctx, mode, f)
+		})
+	default:
+		panic("invalid TxMode passed to WrapTxMode")
+	}
+}
+
+func (d *DB) wrapTxMode(ctx context.Context, mode TxMode, f func(HandleContext) error) error {
+	conn, err := d.root.Connx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err = conn.ExecContext(ctx, "BEGIN "+mode.String()); err != nil {
+		return err
+	}
+
+	committed := false
+	defer func() {
+		if committed {
+			return
+		}
+		// Reached if fn returned an error or panicked, or if
+		// COMMIT failed. If the rollback fails as well, discard
+		// the connection so that it cannot be returned to the
+		// pool with a transaction still open; SQLite rolls back
+		// when the connection is closed.
+		if _, err := conn.ExecContext(context.WithoutCancel(ctx), `ROLLBACK`); err != nil {
+			conn.Raw(func(any) error {
+				return driver.ErrBadConn
+			})
+		}
+	}()
+
+	if err = f(newTx(bindContext(ctx, d.root.DriverName(), conn), 0)); err != nil {
+		return err
+	}
+
+	if _, err = conn.ExecContext(ctx, `COMMIT`); err != nil {
+		return err
+	}
+	committed = true
+	return nil
+}
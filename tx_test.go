@@ -0,0 +1,133 @@
+package localdb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func (suite *DBTestSuite) TestWrapTxMode() {
+	schema := NewSqlSchema(`CREATE TABLE t ( foo TEXT )`)
+
+	holder, err := Open(OpenOptions{File: suite.DBFile, Schema: schema, DriverName: "sqlite"})
+	suite.Require().NoError(err)
+	defer holder.Close()
+
+	writer, err := Open(OpenOptions{File: suite.DBFile, Schema: schema, DriverName: "sqlite"})
+	suite.Require().NoError(err)
+	defer writer.Close()
+
+	insert := func(tx sqlx.Ext) error {
+		_, err := tx.Exec(`INSERT INTO t (foo) VALUES (?)`, "writer")
+		return err
+	}
+
+	for _, mode := range []TxMode{TxDeferred, TxImmediate, TxExclusive} {
+		suite.Run(mode.String(), func() {
+			suite.Require().NoError(holder.WrapTxMode(mode, func(Handle) error {
+				// Without any statements, only non-deferred modes
+				// hold a lock at this point.
+				err := writer.WrapTx(insert)
+				if mode == TxDeferred {
+					suite.Require().NoError(err)
+				} else {
+					suite.Require().True(IsBusy(err), "expected busy error, got %v", err)
+				}
+				return nil
+			}))
+		})
+	}
+
+	errRollback := errors.New("rollback")
+	err = holder.WrapTxMode(TxImmediate, func(tx Handle) error {
+		if err := insert(tx); err != nil {
+			return err
+		}
+		return errRollback
+	})
+	suite.Require().ErrorIs(err, errRollback)
+
+	suite.Require().NoError(holder.WrapTxMode(TxImmediate, insert))
+
+	var count int
+	suite.Require().NoError(sqlx.Get(holder.Handle(), &count, `SELECT COUNT(*) FROM t`))
+	suite.Require().Equal(2, count, "expected one row from the deferred run and one from the committed immediate run")
+}
+
+func (suite *DBTestSuite) TestNestedWrapTx() {
+	schema := NewSqlSchema(`CREATE TABLE t ( foo TEXT )`)
+
+	db, err := Open(OpenOptions{File: suite.DBFile, Schema: schema, DriverName: "sqlite"})
+	suite.Require().NoError(err)
+	defer db.Close()
+
+	errInner := errors.New("inner")
+	insert := func(w TxWrapper, foo string, fail error) error {
+		return w.WrapTx(func(tx *Tx) error {
+			if _, err := tx.Exec(`INSERT INTO t (foo) VALUES (?)`, foo); err != nil {
+				return err
+			}
+			return fail
+		})
+	}
+
+	suite.Require().NoError(db.WrapTx(func(tx *Tx) error {
+		if err := insert(tx, "outer", nil); err != nil {
+			return err
+		}
+		suite.Require().ErrorIs(insert(tx, "failed", errInner), errInner)
+		return tx.WrapTx(func(tx *Tx) error {
+			return insert(tx, "nested", nil)
+		})
+	}))
+
+	var foos []string
+	suite.Require().NoError(sqlx.Select(db.Handle(), &foos, `SELECT foo FROM t ORDER BY rowid`))
+	suite.Require().Equal([]string{"outer", "nested"}, foos)
+
+	err = db.WrapTx(func(tx *Tx) error {
+		if err := insert(tx, "discarded", nil); err != nil {
+			return err
+		}
+		return errInner
+	})
+	suite.Require().ErrorIs(err, errInner)
+
+	foos = nil
+	suite.Require().NoError(sqlx.Select(db.Handle(), &foos, `SELECT foo FROM t ORDER BY rowid`))
+	suite.Require().Equal([]string{"outer", "nested"}, foos, "outer rollback should discard released savepoints")
+}
+
+func (suite *DBTestSuite) TestNestedWrapTxCancel() {
+	schema := NewSqlSchema(`CREATE TABLE t ( foo TEXT )`)
+
+	db, err := Open(OpenOptions{File: suite.DBFile, Schema: schema, DriverName: "sqlite"})
+	suite.Require().NoError(err)
+	defer db.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	err = db.WrapTxContext(ctx, func(tx *Tx) error {
+		return tx.WrapTxContext(ctx, func(tx *Tx) error {
+			if _, err := tx.Exec(`INSERT INTO t (foo) VALUES ('cancelled')`); err != nil {
+				return err
+			}
+			cancel()
+			// Wait for database/sql to roll back the transaction
+			suite.Require().Eventually(func() bool {
+				_, err := tx.ExecContext(context.Background(), `SELECT 1`)
+				return errors.Is(err, sql.ErrTxDone)
+			}, time.Second, time.Millisecond)
+			return errors.New("inner")
+		})
+	})
+	suite.Require().ErrorIs(err, context.Canceled)
+
+	var foos []string
+	suite.Require().NoError(sqlx.Select(db.Handle(), &foos, `SELECT foo FROM t`))
+	suite.Require().Empty(foos)
+}
@@ -0,0 +1,243 @@
+package localdb
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// SchemaObject is a normalized sqlite_master entry.
+type SchemaObject struct {
+	// Type is one of "table", "index", "trigger" or "view".
+	Type  string `db:"type"`
+	Name  string `db:"name"`
+	Table string `db:"tbl_name"`
+
+	// SQL is the object's definition, with runs of whitespace
+	// collapsed to a single space.
+	SQL string `db:"sql"`
+}
+
+func (o SchemaObject) String() string {
+	return fmt.Sprintf("%s %s", o.Type, o.Name)
+}
+
+// SchemaChange describes an object whose definition differs
+// from the one produced by the schema.
+type SchemaChange struct {
+	Expected SchemaObject
+	Actual   SchemaObject
+}
+
+// SchemaDiff is the result of DB.VerifySchema.
+type SchemaDiff struct {
+	// Missing objects are produced by the schema but absent
+	// from the database.
+	Missing []SchemaObject
+
+	// Unexpected objects exist in the database but are not
+	// produced by the schema.
+	Unexpected []SchemaObject
+
+	// Changed objects exist in both, with different definitions.
+	Changed []SchemaChange
+}
+
+// Empty reports whether the database matches the schema.
+func (d *SchemaDiff) Empty() bool {
+	return len(d.Missing) == 0 && len(d.Unexpected) == 0 && len(d.Changed) == 0
+}
+
+func (d *SchemaDiff) String() string {
+	if d.Empty() {
+		return "no schema drift"
+	}
+
+	var b strings.Builder
+	for _, o := range d.Missing {
+		fmt.Fprintf(&b, "missing %s\n", o)
+	}
+	for _, o := range d.Unexpected {
+		fmt.Fprintf(&b, "unexpected %s: %s\n", o, o.SQL)
+	}
+	for _, c := range d.Changed {
+		fmt.Fprintf(&b, "changed %s:\n  expected: %s\n  actual:   %s\n", c.Actual, c.Expected.SQL, c.Actual.SQL)
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// VerifySchema checks the database for schema drift, such as
+// objects that were created, altered or dropped by hand.
+//
+// The SQL of the schema's versions, followed by that of any
+// OpenOptions.Modules, is applied to a scratch in-memory database,
+// and its tables, indexes, triggers and views are compared against
+// the database's sqlite_master. Upgrade hooks and Go steps (see
+// DefineUpgradeFunc) are not run, so any objects they create are
+// reported as unexpected. A Schema that does not implement
+// Planner is built with its Upgrade method instead.
+// Internal objects (named sqlite_* or localdb_*) are ignored.
+//
+// VerifySchema returns an error if the diff could not be
+// produced, for example if the database is not at the schema's
+// latest version. Drift is reported via the returned SchemaDiff,
+// not as an error.
+func (d *DB) VerifySchema() (*SchemaDiff, error) {
+	return d.VerifySchemaContext(context.Background())
+}
+
+// VerifySchemaContext is like VerifySchema, but uses ctx for
+// all database activity.
+func (d *DB) VerifySchemaContext(ctx context.Context) (*SchemaDiff, error) {
+	h := d.handleContext(ctx)
+
+	userVersion, err := d.vs.GetUserVersion(h)
+	if err != nil {
+		return nil, err
+	}
+	if userVersion != d.schema.LatestVersion() {
+		return nil, fmt.Errorf("user_version (%d) does not match the schema version (%d)", userVersion, d.schema.LatestVersion())
+	}
+
+	actual, err := schemaObjects(h)
+	if err != nil {
+		return nil, err
+	}
+
+	scratch, err := sqlx.Open(d.root.DriverName(), ":memory:")
+	if err != nil {
+		return nil, err
+	}
+	defer scratch.Close()
+	// Each connection to :memory: is a separate database
+	scratch.SetMaxOpenConns(1)
+
+	// No transaction is needed, as the scratch database is
+	// discarded. Running without one also allows versions that
+	// cannot run within a transaction.
+	q := bindContext(ctx, scratch.DriverName(), scratch)
+	if planner, ok := d.schema.(Planner); ok {
+		err = applyVersionSQL(q, planner, d.schema.LatestVersion())
+	} else {
+		_, err = d.schema.Upgrade(q, 0)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to build reference schema: %w", err)
+	}
+
+	modules, err := sortModules(d.options.Modules)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range modules {
+		if err = applyVersionSQL(q, m.Schema, m.Schema.LatestVersion()); err != nil {
+			return nil, fmt.Errorf("unable to build reference schema for module %q: %w", m.Name, err)
+		}
+	}
+
+	expected, err := schemaObjects(q)
+	if err != nil {
+		return nil, err
+	}
+
+	return diffSchemaObjects(expected, actual), nil
+}
+
+// applyVersionSQL executes the SQL of versions 1 through latest,
+// without running hooks or Go steps.
+func applyVersionSQL(q sqlx.Execer, planner Planner, latest int32) error {
+	steps, err := planner.PlanSteps(0, latest)
+	if err != nil {
+		return err
+	}
+
+	for _, step := range steps {
+		if step.Func {
+			continue
+		}
+		if _, err = q.Exec(step.SQL); err != nil {
+			return fmt.Errorf("error during v%d schema upgrade: %w", step.Version, err)
+		}
+	}
+	return nil
+}
+
+func schemaObjects(q sqlx.Queryer) ([]SchemaObject, error) {
+	var objects []SchemaObject
+	err := sqlx.Select(q, &objects, `SELECT type, name, tbl_name, COALESCE(sql, '') AS sql FROM sqlite_master
+WHERE name NOT LIKE 'sqlite\_%' ESCAPE '\' AND name NOT LIKE 'localdb\_%' ESCAPE '\'
+ORDER BY type, name`)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range objects {
+		objects[i].SQL = normalizeSQL(objects[i].SQL)
+	}
+	return objects, nil
+}
+
+// normalizeSQL collapses each run of whitespace to a single space,
+// and trims leading and trailing whitespace. String literals and
+// quoted identifiers are left as they are.
+func normalizeSQL(sql string) string {
+	var b strings.Builder
+	var quote rune // closing quote, if within a literal or identifier
+	space := false
+	for _, r := range sql {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case unicode.IsSpace(r):
+			space = true
+			continue
+		case r == '\'' || r == '"' || r == '`':
+			quote = r
+		case r == '[':
+			quote = ']'
+		}
+
+		if space && b.Len() != 0 {
+			b.WriteByte(' ')
+		}
+		space = false
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// diffSchemaObjects compares two lists, each sorted by type and name.
+func diffSchemaObjects(expected, actual []SchemaObject) *SchemaDiff {
+	diff := &SchemaDiff{}
+
+	type key struct{ typ, name string }
+	remaining := make(map[key]SchemaObject, len(actual))
+	for _, o := range actual {
+		remaining[key{o.Type, o.Name}] = o
+	}
+
+	for _, e := range expected {
+		k := key{e.Type, e.Name}
+		a, ok := remaining[k]
+		if !ok {
+			diff.Missing = append(diff.Missing, e)
+			continue
+		}
+		delete(remaining, k)
+		if a != e {
+			diff.Changed = append(diff.Changed, SchemaChange{Expected: e, Actual: a})
+		}
+	}
+
+	for _, a := range actual {
+		if _, ok := remaining[key{a.Type, a.Name}]; ok {
+			diff.Unexpected = append(diff.Unexpected, a)
+		}
+	}
+	return diff
+}
@@ -0,0 +1,53 @@
+package localdb
+
+import (
+	"github.com/jmoiron/sqlx"
+)
+
+func (suite *DBTestSuite) TestVerifySchema() {
+	schema := NewSqlSchema(`CREATE TABLE t (
+	foo TEXT,
+	bar TEXT
+);
+CREATE INDEX t_foo ON t (foo);`)
+	schema.RecordHistory = true
+	schema.DefineUpgrade(2, `CREATE VIEW v AS SELECT foo FROM t;`)
+	schema.DefineUpgrade(3, `CREATE TABLE u ( name TEXT DEFAULT 'a  b' );`)
+
+	hooks := 0
+	schema.DefinePostUpgrade(2, func(tx sqlx.Ext) error {
+		hooks++
+		return nil
+	})
+
+	db, err := Open(OpenOptions{File: suite.DBFile, Schema: schema, DriverName: "sqlite"})
+	suite.Require().NoError(err)
+	defer db.Close()
+
+	diff, err := db.VerifySchema()
+	suite.Require().NoError(err)
+	suite.Require().True(diff.Empty(), diff.String())
+	suite.Require().Equal(1, hooks, "VerifySchema should not run hooks")
+
+	_, err = db.Handle().Exec(`
+DROP INDEX t_foo;
+CREATE INDEX t_bar ON t (bar);
+DROP VIEW v;
+CREATE VIEW v AS SELECT bar FROM t;
+DROP TABLE u;
+CREATE TABLE u ( name TEXT DEFAULT 'a b' );`)
+	suite.Require().NoError(err)
+
+	diff, err = db.VerifySchema()
+	suite.Require().NoError(err)
+	suite.Require().False(diff.Empty())
+	suite.Require().Equal([]SchemaObject{{Type: "index", Name: "t_foo", Table: "t", SQL: "CREATE INDEX t_foo ON t (foo)"}}, diff.Missing)
+	suite.Require().Equal([]SchemaObject{{Type: "index", Name: "t_bar", Table: "t", SQL: "CREATE INDEX t_bar ON t (bar)"}}, diff.Unexpected)
+	suite.Require().Equal([]SchemaChange{{
+		Expected: SchemaObject{Type: "table", Name: "u", Table: "u", SQL: "CREATE TABLE u ( name TEXT DEFAULT 'a  b' )"},
+		Actual:   SchemaObject{Type: "table", Name: "u", Table: "u", SQL: "CREATE TABLE u ( name TEXT DEFAULT 'a b' )"},
+	}, {
+		Expected: SchemaObject{Type: "view", Name: "v", Table: "v", SQL: "CREATE VIEW v AS SELECT foo FROM t"},
+		Actual:   SchemaObject{Type: "view", Name: "v", Table: "v", SQL: "CREATE VIEW v AS SELECT bar FROM t"},
+	}}, diff.Changed)
+}
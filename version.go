@@ -1,7 +1,9 @@
 package localdb
 
 import (
+	"context"
 	"fmt"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 )
@@ -18,12 +20,30 @@ type VersionReader interface {
 	GetUserVersion(tx sqlx.Queryer) (version int32, err error)
 }
 
+// VersionClearer is an optional interface for a FallbackReader
+// whose location can be cleared once FallbackVersion.Migrate has
+// moved its values to the primary VersionStorer.
+type VersionClearer interface {
+	ClearVersion(tx sqlx.Execer) error
+}
+
 type FallbackVersion struct {
 	// Primary
 	VersionStorer
 
 	// Secondary
 	FallbackReader VersionReader
+
+	// Migrate, if true, makes Open finish moving a database's
+	// version information from FallbackReader to the primary.
+	// Once Open has brought the database up to date, if
+	// FallbackReader still reports an application ID, a follow-up
+	// transaction copies the values to the primary (unless the
+	// upgrade already wrote them), clears FallbackReader if it
+	// implements VersionClearer, and records the migration in the
+	// localdb_meta table. From then on, FallbackReader is not
+	// consulted for that database.
+	Migrate bool
 }
 
 func (f *FallbackVersion) GetApplicationId(tx sqlx.Queryer) (appId int32, err error) {
@@ -31,6 +51,9 @@ func (f *FallbackVersion) GetApplicationId(tx sqlx.Queryer) (appId int32, err er
 	if err != nil || appId != 0 {
 		return
 	}
+	if migrated, err := f.Migrated(tx); err != nil || migrated {
+		return 0, err
+	}
 
 	return f.FallbackReader.GetApplicationId(tx)
 }
@@ -40,10 +63,77 @@ func (f *FallbackVersion) GetUserVersion(tx sqlx.Queryer) (userVersion int32, er
 	if err != nil || userVersion != 0 {
 		return
 	}
+	if migrated, err := f.Migrated(tx); err != nil || migrated {
+		return 0, err
+	}
 
 	return f.FallbackReader.GetUserVersion(tx)
 }
 
+// Migrated reports whether Open has migrated the database away
+// from FallbackReader. It is always false unless Migrate is set.
+func (f *FallbackVersion) Migrated(q sqlx.Queryer) (bool, error) {
+	if !f.Migrate {
+		return false, nil
+	}
+	_, ok, err := getMeta(q, metaFallbackMigratedAt)
+	return ok, err
+}
+
+// migrateFallback completes FallbackVersion.Migrate once Open has
+// brought the database up to date.
+func migrateFallback(ctx context.Context, db *DB, vs VersionStorer) error {
+	f, ok := vs.(*FallbackVersion)
+	if !ok || !f.Migrate {
+		return nil
+	}
+
+	h := db.handleContext(ctx)
+	if migrated, err := f.Migrated(h); err != nil || migrated {
+		return err
+	}
+	if appId, err := f.FallbackReader.GetApplicationId(h); err != nil || appId == 0 {
+		return err
+	}
+
+	return db.WrapTxContext(ctx, func(tx sqlx.Ext) error {
+		primary, err := f.VersionStorer.GetApplicationId(tx)
+		if err != nil {
+			return err
+		}
+
+		// If the database was already up to date, Open has not
+		// written anything to the primary yet.
+		if primary == 0 {
+			appId, err := f.FallbackReader.GetApplicationId(tx)
+			if err != nil {
+				return err
+			}
+			userVersion, err := f.FallbackReader.GetUserVersion(tx)
+			if err != nil {
+				return err
+			}
+			if err = f.VersionStorer.SetApplicationId(tx, appId); err != nil {
+				return err
+			}
+			if err = f.VersionStorer.SetUserVersion(tx, userVersion); err != nil {
+				return err
+			}
+		}
+
+		if clearer, ok := f.FallbackReader.(VersionClearer); ok {
+			if err = clearer.ClearVersion(tx); err != nil {
+				return fmt.Errorf("unable to clear fallback version: %w", err)
+			}
+		}
+
+		if err = createMetaTable(tx); err != nil {
+			return err
+		}
+		return putMeta(tx, metaFallbackMigratedAt, time.Now().UTC().Format(time.RFC3339Nano))
+	})
+}
+
 // SqliteVersion stores version information in
 // the application_id and user_version fields.
 type SqliteVersion struct{}
@@ -74,3 +164,12 @@ func (sv *SqliteVersion) SetApplicationId(tx sqlx.Execer, appId int32) error {
 func (sv *SqliteVersion) SetUserVersion(tx sqlx.Execer, version int32) error {
 	return sv.setPragma(tx, "user_version", version)
 }
+
+// ClearVersion implements VersionClearer by resetting both
+// pragmas to 0.
+func (sv *SqliteVersion) ClearVersion(tx sqlx.Execer) error {
+	if err := sv.SetApplicationId(tx, 0); err != nil {
+		return err
+	}
+	return sv.SetUserVersion(tx, 0)
+}
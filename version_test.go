@@ -0,0 +1,100 @@
+package localdb
+
+import (
+	"github.com/jmoiron/sqlx"
+)
+
+func (suite *DBTestSuite) TestFallbackMigrateFromPragmas() {
+	schema := NewSqlSchema(`CREATE TABLE t ( foo TEXT )`)
+
+	db, err := Open(OpenOptions{File: suite.DBFile, Schema: schema, DriverName: "sqlite"})
+	suite.Require().NoError(err)
+	suite.Require().NoError(db.Close())
+
+	tv := &TableVersion{}
+	fv := &FallbackVersion{VersionStorer: tv, FallbackReader: &SqliteVersion{}, Migrate: true}
+
+	// The database is already up to date, so only the migration runs
+	db, err = Open(OpenOptions{File: suite.DBFile, Schema: schema, DriverName: "sqlite", VersionStorer: fv})
+	suite.Require().NoError(err)
+	defer db.Close()
+
+	meta, err := tv.Metadata(db.Handle())
+	suite.Require().NoError(err)
+	suite.Require().Equal(schema.ApplicationID(), meta.ApplicationID)
+	suite.Require().Equal(int32(1), meta.UserVersion)
+
+	pragmas := &SqliteVersion{}
+	appId, err := pragmas.GetApplicationId(db.Handle())
+	suite.Require().NoError(err)
+	suite.Require().Zero(appId, "pragmas should be cleared")
+
+	migrated, err := fv.Migrated(db.Handle())
+	suite.Require().NoError(err)
+	suite.Require().True(migrated)
+}
+
+// legacyTableVersion reads a version table from before the
+// application used localdb.
+type legacyTableVersion struct{}
+
+func (legacyTableVersion) get(q sqlx.Queryer, column string) (int32, error) {
+	var value []int32
+	if exists, err := tableExists(q, "legacy_version"); err != nil || !exists {
+		return 0, err
+	}
+	if err := sqlx.Select(q, &value, `SELECT `+column+` FROM legacy_version`); err != nil || len(value) == 0 {
+		return 0, err
+	}
+	return value[0], nil
+}
+
+func (l legacyTableVersion) GetApplicationId(q sqlx.Queryer) (int32, error) {
+	return l.get(q, "app_id")
+}
+
+func (l legacyTableVersion) GetUserVersion(q sqlx.Queryer) (int32, error) {
+	return l.get(q, "version")
+}
+
+func (legacyTableVersion) ClearVersion(tx sqlx.Execer) error {
+	_, err := tx.Exec(`DELETE FROM legacy_version`)
+	return err
+}
+
+func (suite *DBTestSuite) TestFallbackMigrateFromTable() {
+	schema := NewSqlSchema(`CREATE TABLE t ( foo TEXT )`)
+	schema.DefineUpgrade(2, `ALTER TABLE t ADD COLUMN bar TEXT;`)
+
+	sq := openRaw(suite.T(), suite.DBFile)
+	_, err := sq.Exec(`CREATE TABLE t ( foo TEXT );
+CREATE TABLE legacy_version ( app_id INTEGER, version INTEGER );
+INSERT INTO legacy_version VALUES (?, 1);`, schema.ApplicationID())
+	suite.Require().NoError(err)
+	suite.Require().NoError(sq.Close())
+
+	fv := &FallbackVersion{VersionStorer: &SqliteVersion{}, FallbackReader: legacyTableVersion{}, Migrate: true}
+	db, err := Open(OpenOptions{File: suite.DBFile, Schema: schema, DriverName: "sqlite", VersionStorer: fv})
+	suite.Require().NoError(err, "v1 should be read from the legacy table and upgraded")
+	defer db.Close()
+
+	userVersion, err := (&SqliteVersion{}).GetUserVersion(db.Handle())
+	suite.Require().NoError(err)
+	suite.Require().Equal(int32(2), userVersion)
+
+	var count int
+	suite.Require().NoError(sqlx.Get(db.Handle(), &count, `SELECT COUNT(*) FROM legacy_version`))
+	suite.Require().Zero(count, "legacy table should be cleared")
+
+	// Stale fallback values are ignored once migrated
+	_, err = db.Handle().Exec(`INSERT INTO legacy_version VALUES (?, 1); PRAGMA user_version = 0;`, schema.ApplicationID())
+	suite.Require().NoError(err)
+	userVersion, err = fv.GetUserVersion(db.Handle())
+	suite.Require().NoError(err)
+	suite.Require().Zero(userVersion)
+
+	fv.Migrate = false
+	userVersion, err = fv.GetUserVersion(db.Handle())
+	suite.Require().NoError(err)
+	suite.Require().Equal(int32(1), userVersion)
+}